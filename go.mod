@@ -5,6 +5,8 @@ go 1.23.0
 toolchain go1.23.4
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	golang.org/x/net v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,11 +2,25 @@ package main
 
 import (
 	"dnsthingymagik/server"
+	"dnsthingymagik/server/config"
+	"flag"
 	"log"
 )
 
 func main() {
-	s, err := server.NewServer(":53")
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s, err := server.NewServerWithConfig(":53", cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"cmp"
+	"dnsthingymagik/server/blocklist"
+	"dnsthingymagik/server/clients"
+	"dnsthingymagik/server/config"
+	"dnsthingymagik/server/edns"
+	"dnsthingymagik/server/recordcache"
+	"dnsthingymagik/server/resolver"
+	"dnsthingymagik/server/safesearch"
+	"dnsthingymagik/server/schedule"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// policy is how the server treats a group of clients: the lists it filters with and
+// the resolver answering for it.
+type policy struct {
+	name  string
+	lists []int // indexes of its lists in the server's lists
+	// Swapped whole when a list is refreshed, nil when the group filters nothing
+	blocklist  atomic.Pointer[blocklist.Blocklist]
+	resolver   *resolver.Resolver
+	cache      *recordcache.Cache // own cache of a group with upstreams, nil when it shares the server's
+	safeSearch bool
+}
+
+// Build the default policy, which applies every list, and one policy per client group.
+// Needs the server's resolver, groups without upstreams share it.
+func (s *Server) loadPolicies() error {
+	lists, err := configuredLists(s.config)
+	if err != nil {
+		return err
+	}
+	blocklist.Prefetch(lists)
+	s.lists = lists
+
+	// Each list is compiled once, groups with the same list share its rules
+	s.rules = make([]*blocklist.Rules, len(lists))
+	all := make([]int, len(lists))
+	for i, list := range lists {
+		s.rules[i], err = blocklist.Compile(list)
+		if err != nil {
+			return err
+		}
+		all[i] = i
+	}
+
+	s.policy = &policy{name: "default", lists: all, resolver: s.resolver, safeSearch: s.config.SafeSearch}
+	s.buildBlocklist(s.policy)
+
+	s.policies = make(map[string]*policy)
+	var groups []clients.Group
+	for _, group := range s.config.Groups {
+		p := &policy{name: group.Name, lists: selectLists(lists, group), resolver: s.resolver, safeSearch: group.SafeSearch}
+		s.buildBlocklist(p)
+
+		if len(group.Upstreams) > 0 {
+			// Own cache too, the group's upstreams may well answer differently
+			groupConfig := *s.config
+			groupConfig.Mode = config.ModeForward
+			groupConfig.Upstreams = group.Upstreams
+			if group.UpstreamStrategy != "" {
+				groupConfig.UpstreamStrategy = group.UpstreamStrategy
+			}
+			p.cache = recordcache.NewCache()
+			p.resolver, err = newResolver(p.cache, &groupConfig)
+			if err != nil {
+				p.cache.Close()
+				return fmt.Errorf("group %s: %w", group.Name, err)
+			}
+		}
+
+		s.policies[group.Name] = p
+		groups = append(groups, clients.Group{Name: group.Name, Clients: group.Clients})
+	}
+
+	needSafeSearch := s.policy.safeSearch
+	for _, p := range s.policies {
+		needSafeSearch = needSafeSearch || p.safeSearch
+	}
+	if needSafeSearch {
+		s.safeSearch, err = safesearch.Load(s.config.SafeSearchFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.LeasesFile != "" {
+		s.leases, err = clients.LoadLeases(s.config.LeasesFile)
+		if err != nil {
+			return err
+		}
+	}
+	s.clients, err = clients.NewMatcher(groups, s.leases)
+	if err != nil {
+		return err
+	}
+
+	s.relays, err = clients.ParseNetworks(s.config.ClientSubnetFrom)
+	if err != nil {
+		return fmt.Errorf("client_subnet_from: %w", err)
+	}
+	return nil
+}
+
+// Combine the policy's compiled lists into its matcher and swap it in, queries being
+// answered keep the one they started with.
+func (s *Server) buildBlocklist(p *policy) {
+	if len(p.lists) == 0 {
+		return
+	}
+	var rules []*blocklist.Rules
+	for _, i := range p.lists {
+		rules = append(rules, s.rules[i])
+	}
+	p.blocklist.Store(blocklist.New(rules...))
+}
+
+// Compile a downloaded list again after it changed and rebuild the policies using it. A
+// list that fails to load keeps its old rules.
+func (s *Server) reloadLists(changed blocklist.List) {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+
+	log.Printf("List %s changed, reloading", cmp.Or(changed.Name, changed.URL))
+	var reloaded []int
+	for i, list := range s.lists {
+		if list.URL != changed.URL || list.Path != changed.Path {
+			continue
+		}
+		rules, err := blocklist.Compile(list)
+		if err != nil {
+			log.Printf("List %s reload error, keeping the old rules: %v", cmp.Or(list.Name, list.URL), err)
+			return
+		}
+		s.rules[i] = rules
+		reloaded = append(reloaded, i)
+	}
+
+	for _, p := range append([]*policy{s.policy}, slices.Collect(maps.Values(s.policies))...) {
+		if slices.ContainsFunc(p.lists, func(i int) bool { return slices.Contains(reloaded, i) }) {
+			s.buildBlocklist(p)
+		}
+	}
+}
+
+// Every configured block and allow list, in config order.
+func configuredLists(cfg *config.Config) ([]blocklist.List, error) {
+	schedules := make(map[string]*schedule.Schedule)
+	for _, sched := range cfg.Schedules {
+		parsed, err := sched.Parse()
+		if err != nil {
+			return nil, err
+		}
+		schedules[sched.Name] = parsed
+	}
+
+	var lists []blocklist.List
+	for _, list := range cfg.Blocklists {
+		sinkhole, err := blocklist.ParseSinkhole(list.Response, list.Sinkhole)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist %s: %w", cmp.Or(list.Name, list.Path), err)
+		}
+		lists = append(lists, blocklist.List{
+			Name:     list.Name,
+			Path:     list.Path,
+			URL:      list.URL,
+			Refresh:  time.Duration(list.RefreshMinutes) * time.Minute,
+			Rules:    list.Rules,
+			Response: list.Response,
+			Sinkhole: sinkhole,
+			TTL:      list.TTL,
+			Schedule: schedules[list.Schedule],
+		})
+	}
+	for _, list := range cfg.Allowlists {
+		lists = append(lists, blocklist.List{
+			Name:     list.Name,
+			Path:     list.Path,
+			URL:      list.URL,
+			Refresh:  time.Duration(list.RefreshMinutes) * time.Minute,
+			Rules:    list.Rules,
+			Allow:    true,
+			Schedule: schedules[list.Schedule],
+		})
+	}
+	return lists, nil
+}
+
+// Indexes of the lists a group names, lists without a name are referred to by their path.
+// Block and allow lists are separate namespaces, a blocklist and an allowlist may share a name.
+func selectLists(lists []blocklist.List, group config.Group) []int {
+	wanted := map[bool]map[string]bool{false: {}, true: {}} // by Allow
+	for _, name := range group.Blocklists {
+		wanted[false][name] = true
+	}
+	for _, name := range group.Allowlists {
+		wanted[true][name] = true
+	}
+
+	var selected []int
+	for i, list := range lists {
+		names := wanted[list.Allow]
+		if names[list.Name] || (list.Name == "" && names[list.Path]) {
+			selected = append(selected, i)
+		}
+	}
+	return selected
+}
+
+// Policy for the client at addr. Behind another resolver every query comes from the
+// same address, so the EDNS Client Subnet stands for the client when configured and
+// the query comes from a trusted relay; anyone else could claim any subnet.
+func (s *Server) policyFor(addr net.Addr, opt *edns.OPT) *policy {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if subnet := opt.ClientSubnet(); subnet != nil && s.config.UseClientSubnet && s.relays.Contains(ip) {
+		ip = subnet.IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if p, ok := s.policies[s.clients.Group(ip)]; ok {
+		return p
+	}
+	return s.policy
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"dnsthingymagik/server/blocklist"
+	"dnsthingymagik/server/clients"
+	"dnsthingymagik/server/config"
+	"dnsthingymagik/server/edns"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_ReloadListsRebuildsAffectedPolicies(t *testing.T) {
+	dir := t.TempDir()
+	lists := []blocklist.List{
+		{Name: "ads", URL: "http://lists.example/ads", Path: filepath.Join(dir, "ads.txt")},
+		{Name: "malware", URL: "http://lists.example/malware", Path: filepath.Join(dir, "malware.txt")},
+	}
+	for i, content := range []string{"ads.example.com\n", "malware.example.com\n"} {
+		if err := os.WriteFile(lists[i].Path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{lists: lists, policies: make(map[string]*policy)}
+	for _, list := range lists {
+		rules, err := blocklist.Compile(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.rules = append(s.rules, rules)
+	}
+	s.policy = &policy{name: "default", lists: []int{0, 1}}
+	s.policies["kids"] = &policy{name: "kids", lists: []int{0}}
+	s.policies["iot"] = &policy{name: "iot", lists: []int{1}}
+	for _, p := range []*policy{s.policy, s.policies["kids"], s.policies["iot"]} {
+		s.buildBlocklist(p)
+	}
+	before := s.policies["iot"].blocklist.Load()
+
+	if err := os.WriteFile(lists[0].Path, []byte("tracker.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadLists(lists[0])
+
+	blocked := func(p *policy, name string) bool {
+		rule, _ := p.blocklist.Load().Blocked(dnsmessage.MustNewName(name), time.Now())
+		return rule != nil
+	}
+	for _, p := range []*policy{s.policy, s.policies["kids"]} {
+		if blocked(p, "ads.example.com.") || !blocked(p, "tracker.example.com.") {
+			t.Errorf("%s: expected the reloaded list", p.name)
+		}
+	}
+	if !blocked(s.policy, "malware.example.com.") {
+		t.Error("default: expected the other list to stay")
+	}
+	if s.policies["iot"].blocklist.Load() != before {
+		t.Error("iot: expected a group without the list to keep its blocklist")
+	}
+}
+
+func Test_SelectLists(t *testing.T) {
+	lists := []blocklist.List{
+		{Name: "ads"},
+		{Name: "social"},
+		{Path: "/lists/unnamed.txt"},
+		{Name: "social", Allow: true},
+		{Name: "work", Allow: true},
+	}
+	tests := []struct {
+		name  string
+		group config.Group
+		want  []int
+	}{
+		{name: "blocklist names only match blocklists", group: config.Group{Blocklists: []string{"social"}}, want: []int{1}},
+		{name: "allowlist names only match allowlists", group: config.Group{Allowlists: []string{"social"}}, want: []int{3}},
+		{name: "both", group: config.Group{Blocklists: []string{"ads", "social"}, Allowlists: []string{"social"}}, want: []int{0, 1, 3}},
+		{name: "unnamed list by path", group: config.Group{Blocklists: []string{"/lists/unnamed.txt"}}, want: []int{2}},
+		{name: "a blocklist listed as allowlist is not selected", group: config.Group{Allowlists: []string{"ads"}, Blocklists: []string{"work"}}},
+	}
+	for _, tt := range tests {
+		if got := selectLists(lists, tt.group); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func Test_PolicyForClientSubnet(t *testing.T) {
+	matcher, err := clients.NewMatcher([]clients.Group{{Name: "kids", Clients: []string{"10.0.0.0/24"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relays, err := clients.ParseNetworks([]string{"192.0.2.53", "2001:db8::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		config:   &config.Config{UseClientSubnet: true},
+		policy:   &policy{name: "default"},
+		policies: map[string]*policy{"kids": {name: "kids"}},
+		clients:  matcher,
+		relays:   relays,
+	}
+	// 10.0.0.0/24, a kid behind the relay
+	ecs := &edns.OPT{Options: []dnsmessage.Option{{Code: edns.OptionCodeECS, Data: []byte{0, 1, 24, 0, 10, 0, 0}}}}
+
+	tests := []struct {
+		name string
+		from string
+		opt  *edns.OPT
+		want string
+	}{
+		{name: "subnet from a trusted relay", from: "192.0.2.53", opt: ecs, want: "kids"},
+		{name: "subnet from a relay in a trusted network", from: "2001:db8::7", opt: ecs, want: "kids"},
+		{name: "subnet from anyone else is ignored", from: "192.0.2.99", opt: ecs, want: "default"},
+		{name: "relay without a subnet", from: "192.0.2.53", want: "default"},
+		{name: "client asking directly", from: "10.0.0.5", want: "kids"},
+		{name: "client claiming another subnet", from: "10.0.0.5", opt: &edns.OPT{Options: []dnsmessage.Option{{Code: edns.OptionCodeECS, Data: []byte{0, 1, 24, 0, 172, 16, 0}}}}, want: "kids"},
+	}
+	for _, tt := range tests {
+		for _, addr := range []net.Addr{&net.UDPAddr{IP: net.ParseIP(tt.from)}, &net.TCPAddr{IP: net.ParseIP(tt.from)}} {
+			if got := s.policyFor(addr, tt.opt).name; got != tt.want {
+				t.Errorf("%s (%s): expected %s, got %s", tt.name, addr.Network(), tt.want, got)
+			}
+		}
+	}
+
+	// Switched off, even a trusted relay's subnet is ignored
+	s.config.UseClientSubnet = false
+	if got := s.policyFor(&net.UDPAddr{IP: net.ParseIP("192.0.2.53")}, ecs).name; got != "default" {
+		t.Errorf("Expected the subnet ignored when switched off, got %s", got)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"dnsthingymagik/server/blocklist"
+	"dnsthingymagik/server/hostsfile"
+	"dnsthingymagik/server/localrecords"
+	"dnsthingymagik/server/resolver"
+	"dnsthingymagik/server/resolver/entities"
+	"dnsthingymagik/server/rpz"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+var ErrLocalCNAMELoop = errors.New("local CNAME chain too long")
+
+// Load the local records and hosts files the config names.
+func (s *Server) loadLocalData() error {
+	var err error
+	if s.config.LocalRecordsFile != "" {
+		s.local, err = localrecords.Load(s.config.LocalRecordsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.HostsFiles) > 0 {
+		s.hosts, err = hostsfile.Load(s.config.HostsFiles, s.config.HostsTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.RPZ) > 0 {
+		var zones []rpz.Zone
+		for _, zone := range s.config.RPZ {
+			zones = append(zones, rpz.Zone{Name: zone.Zone, Path: zone.Path})
+		}
+		s.rpz, err = rpz.Load(zones)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Answer a question from the local data, or resolve it when the name is not local.
+// A local CNAME is followed through the local data and, once it leaves it, the resolver.
+func (s *Server) answer(q dnsmessage.Question, id uint16, p *policy) (entities.Result, error) {
+	result, found := s.lookupLocal(q.Name, q.Type)
+	if !found {
+		return s.resolve(q.Name, id, q.Type, p)
+	}
+
+	answers := result.Answers
+	for hops := 0; ; hops++ {
+		target, ok := cnameTarget(result.Answers, q.Type)
+		if !ok {
+			break
+		}
+		if hops == resolver.MaxCNAMEChain {
+			return entities.Result{}, ErrLocalCNAMELoop
+		}
+
+		next, found := s.lookupLocal(target, q.Type)
+		if !found {
+			resolved, err := s.resolve(target, id, q.Type, p)
+			if err != nil {
+				return entities.Result{}, err
+			}
+			// Only the alias is ours, the rest came from recursion so the answer is not authoritative
+			return entities.Result{
+				RCode:     resolved.RCode,
+				Answers:   append(answers, resolved.Answers...),
+				Authority: resolved.Authority,
+				Options:   resolved.Options,
+			}, nil
+		}
+
+		answers = append(answers, next.Answers...)
+		result = next
+	}
+
+	result.Answers = answers
+	return result, nil
+}
+
+// Resolve a name that is not local with the client's resolver, unless a response policy
+// or its lists block it, or safe search sends it elsewhere.
+// When a schedule decides the name, clients may only cache the answer until it flips.
+func (s *Server) resolve(name dnsmessage.Name, id uint16, rtype dnsmessage.Type, p *policy) (entities.Result, error) {
+	// Response policy zones come before the lists, a passthru skips the lists too.
+	// A question name trigger decides right away unless an earlier zone has triggers
+	// on the response, those need the answer first.
+	zp := s.rpz.QName(name)
+	if zp != nil && zp.Action != rpz.ActionPassthru && !s.rpz.NeedsResponse(zp) {
+		return s.rpzAnswer(name, id, rtype, p, zp)
+	}
+
+	now := time.Now()
+	var until time.Time
+	if zp == nil {
+		var rule *blocklist.Rule
+		rule, until = p.blocklist.Load().Blocked(name, now)
+		if rule != nil {
+			log.Printf("Blocked %s by %s for group %s", name, rule, p.name)
+			return capTTL(rule.Answer(name, rtype), now, until), nil
+		}
+	}
+
+	var result entities.Result
+	var err error
+	if target, ok := s.safeSearch.Target(name); ok && p.safeSearch {
+		result, err = s.safeSearchAnswer(name, target, id, rtype, p)
+	} else {
+		result, err = p.resolver.ResolveDN(name, id, rtype)
+	}
+	if err != nil {
+		// Without a response to check, the question name trigger still holds
+		if zp != nil && zp.Action != rpz.ActionPassthru {
+			return s.rpzAnswer(name, id, rtype, p, zp)
+		}
+		return result, err
+	}
+
+	// Addresses in the answer and the nameservers of its names, in the zones before zp
+	nameservers := func(owner dnsmessage.Name) []entities.Record {
+		records, err := p.resolver.Nameservers(owner, id)
+		if err != nil {
+			log.Printf("RPZ nameservers of %s: %v", owner, err)
+		}
+		return records
+	}
+	if hit := s.rpz.Response(name, result, nameservers, zp); hit != nil {
+		zp = hit
+	}
+	if zp != nil && zp.Action != rpz.ActionPassthru {
+		return s.rpzAnswer(name, id, rtype, p, zp)
+	}
+	return capTTL(result, now, until), nil
+}
+
+// Cap the TTLs of a result at the time left until, unless it is zero. The records may
+// be shared with the cache and other callers, so the result gets copies.
+func capTTL(result entities.Result, now, until time.Time) entities.Result {
+	if until.IsZero() {
+		return result
+	}
+	ttl := uint32(max(math.Ceil(until.Sub(now).Seconds()), 1))
+
+	capped := func(records []entities.Record) []entities.Record {
+		out := make([]entities.Record, len(records))
+		for i, record := range records {
+			record.TTL = min(record.TTL, ttl)
+			out[i] = record
+		}
+		return out
+	}
+	result.Answers = capped(result.Answers)
+	result.Authority = capped(result.Authority)
+	return result
+}
+
+// Answer a CHAOS TXT question with what decides the name for this client: local data,
+// a response policy, a list rule or nothing, and a safe search rewrite.
+func (s *Server) explain(q dnsmessage.Question, p *policy) entities.Result {
+	if q.Type != dnsmessage.TypeTXT || reservedChaos(q.Name) {
+		return entities.Result{RCode: dnsmessage.RCodeRefused}
+	}
+
+	// Same order as resolve, response policy zones before the lists
+	var rule *blocklist.Rule
+	var until time.Time
+	var decision string
+	zp := s.rpz.QName(q.Name)
+	if zp != nil {
+		decision = zp.Explain()
+	} else {
+		rule, until = p.blocklist.Load().Match(q.Name, time.Now())
+		decision = rule.Explain()
+	}
+
+	text := fmt.Sprintf("group %s: %s", p.name, decision)
+	passed := zp == nil || zp.Action == rpz.ActionPassthru
+	if target, ok := s.safeSearch.Target(q.Name); ok && p.safeSearch && passed && (rule == nil || rule.Allow) {
+		text += fmt.Sprintf(", safe search rewrites it to %s", target)
+	}
+	if !until.IsZero() {
+		text += fmt.Sprintf(", until %s", until.Format(time.RFC3339))
+	}
+	if s.rpz.NeedsResponse(zp) {
+		text += ", unless the answer triggers a response policy"
+	}
+	if _, found := s.lookupLocal(q.Name, dnsmessage.TypeA); found {
+		text = fmt.Sprintf("group %s: answered from local records or hosts files", p.name)
+	}
+
+	return entities.Result{
+		RCode: dnsmessage.RCodeSuccess,
+		Answers: []entities.Record{{
+			Name:  q.Name,
+			RType: dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassCHAOS,
+			Body:  &dnsmessage.TXTResource{TXT: []string{text}},
+		}},
+	}
+}
+
+// Names like version.bind and id.server (RFC 4892) ask about the server software, not
+// a domain; they are not explained.
+func reservedChaos(name dnsmessage.Name) bool {
+	lower := strings.ToLower(name.String())
+	return lower == "bind." || strings.HasSuffix(lower, ".bind.") || lower == "server." || strings.HasSuffix(lower, ".server.")
+}
+
+// Local records take precedence over the hosts files.
+func (s *Server) lookupLocal(name dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, bool) {
+	if result, found := s.local.Lookup(name, rtype); found {
+		return result, true
+	}
+	return s.hosts.Lookup(name, rtype)
+}
+
+// Target of a CNAME answer that still has to be followed for rtype.
+func cnameTarget(answers []entities.Record, rtype dnsmessage.Type) (dnsmessage.Name, bool) {
+	if rtype == dnsmessage.TypeCNAME || len(answers) == 0 {
+		return dnsmessage.Name{}, false
+	}
+	cname, ok := answers[len(answers)-1].Body.(*dnsmessage.CNAMEResource)
+	if !ok {
+		return dnsmessage.Name{}, false
+	}
+	return cname.CNAME, true
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"dnsthingymagik/server/config"
+	"dnsthingymagik/server/edns"
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ReservedChaos(t *testing.T) {
+	tests := map[string]bool{
+		"version.bind.":    true,
+		"HOSTNAME.BIND.":   true,
+		"id.server.":       true,
+		"bind.":            true,
+		"ads.example.com.": false,
+		"bind.example.":    false,
+		"myserver.":        false,
+	}
+	for name, want := range tests {
+		if got := reservedChaos(dnsmessage.MustNewName(name)); got != want {
+			t.Errorf("%s: expected reserved=%v, got %v", name, want, got)
+		}
+	}
+}
+
+func Test_LocalCNAMEKeepsBlockedOption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.json")
+	records := `{"records": [{"name": "www.home", "type": "CNAME", "values": ["ads.example.com"]}]}`
+	if err := os.WriteFile(path, []byte(records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Mode = config.ModeForward
+	cfg.Upstreams = []string{stubUpstream(t, nil, nil)}
+	cfg.LocalRecordsFile = path
+	cfg.Blocklists = []config.Blocklist{{Name: "ads", Rules: []string{"ads.example.com"}}}
+	s, err := NewServerWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(s.Close)
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.home."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	result, err := s.answer(q, 1, s.policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RCode != dnsmessage.RCodeNameError || len(result.Answers) != 1 {
+		t.Errorf("Expected the local CNAME and NXDOMAIN for the blocked target, got %s with %d answers", result.RCode, len(result.Answers))
+	}
+	if len(result.Options) != 1 || result.Options[0].Code != edns.OptionCodeEDE {
+		t.Errorf("Expected the Extended DNS Error of the block, got %+v", result.Options)
+	}
+}
+
+func Test_ExplainRPZ(t *testing.T) {
+	dir := t.TempDir()
+	zone := `$TTL 60
+@                    SOA ns.rpz.local. admin.rpz.local. 1 3600 600 86400 60
+bad.example.com      CNAME .
+*.bad.example.com    CNAME .
+ok.ads.example.com   CNAME rpz-passthru.
+`
+	path := filepath.Join(dir, "rpz.local.zone")
+	if err := os.WriteFile(path, []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Mode = config.ModeForward
+	cfg.Upstreams = []string{stubUpstream(t, nil, nil)}
+	cfg.RPZ = []config.RPZZone{{Zone: "rpz.local", Path: path}}
+	cfg.Blocklists = []config.Blocklist{{Name: "ads", Rules: []string{"ads.example.com"}}}
+	s, err := NewServerWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(s.Close)
+
+	tests := map[string]string{
+		"bad.example.com.":    `group default: answered NXDOMAIN by trigger "bad.example.com" of rpz rpz.local.`,
+		"x.bad.example.com.":  `group default: answered NXDOMAIN by trigger "*.bad.example.com" of rpz rpz.local.`,
+		"ok.ads.example.com.": `group default: passed through without the lists by trigger "ok.ads.example.com" of rpz rpz.local.`,
+		"x.ads.example.com.":  `group default: blocked by rule "ads.example.com" of list ads`,
+		"example.com.":        "group default: not on any list",
+	}
+	for name, want := range tests {
+		result := s.explain(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS}, s.policy)
+		if len(result.Answers) != 1 {
+			t.Errorf("%s: expected one TXT answer, got %+v", name, result)
+			continue
+		}
+		if got := result.Answers[0].Body.(*dnsmessage.TXTResource).TXT[0]; got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"dnsthingymagik/server/rpz"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+)
+
+// Answer name as the response policy says, following a local data CNAME with the client's resolver.
+func (s *Server) rpzAnswer(name dnsmessage.Name, id uint16, rtype dnsmessage.Type, p *policy, zp *rpz.Policy) (entities.Result, error) {
+	log.Printf("Rewrote %s by %s for group %s", name, zp, p.name)
+	result, err := zp.Answer(name, rtype)
+	if err != nil {
+		return entities.Result{}, err
+	}
+
+	target, ok := cnameTarget(result.Answers, rtype)
+	if !ok {
+		return result, nil
+	}
+	resolved, err := p.resolver.ResolveDN(target, id, rtype)
+	if err != nil {
+		return entities.Result{}, err
+	}
+	return entities.Result{
+		RCode:     resolved.RCode,
+		Answers:   append(result.Answers, resolved.Answers...),
+		Authority: resolved.Authority,
+		Options:   result.Options,
+	}, nil
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"dnsthingymagik/server/safesearch"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answer name with a CNAME to its safe search endpoint, followed by the endpoint's records.
+func (s *Server) safeSearchAnswer(name, target dnsmessage.Name, id uint16, rtype dnsmessage.Type, p *policy) (entities.Result, error) {
+	cname := entities.Record{
+		Name:  name,
+		RType: dnsmessage.TypeCNAME,
+		Class: dnsmessage.ClassINET,
+		TTL:   safesearch.TTL,
+		Body:  &dnsmessage.CNAMEResource{CNAME: target},
+	}
+	if rtype == dnsmessage.TypeCNAME {
+		return entities.Result{RCode: dnsmessage.RCodeSuccess, Answers: []entities.Record{cname}}, nil
+	}
+
+	resolved, err := p.resolver.ResolveDN(target, id, rtype)
+	if err != nil {
+		return entities.Result{}, err
+	}
+	return entities.Result{
+		RCode:     resolved.RCode,
+		Answers:   append([]entities.Record{cname}, resolved.Answers...),
+		Authority: resolved.Authority,
+		Options:   resolved.Options,
+	}, nil
+}
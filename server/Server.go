@@ -2,43 +2,169 @@ package server
 
 import (
 	"context"
+	"dnsthingymagik/server/blocklist"
+	"dnsthingymagik/server/clients"
+	"dnsthingymagik/server/config"
+	"dnsthingymagik/server/edns"
+	"dnsthingymagik/server/hostsfile"
+	"dnsthingymagik/server/localrecords"
 	"dnsthingymagik/server/recordcache"
 	"dnsthingymagik/server/resolver"
 	"dnsthingymagik/server/resolver/entities"
+	"dnsthingymagik/server/rpz"
+	"dnsthingymagik/server/safesearch"
+	"errors"
 	"golang.org/x/net/dns/dnsmessage"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+// Meta query types that cannot be answered from resolved RRsets get NOTIMP,
+// every other type is resolved and passed through opaquely (RFC 3597)
+var unsupportedTypes = map[dnsmessage.Type]bool{
+	dnsmessage.TypeOPT:   true,
+	dnsmessage.TypeAXFR:  true,
+	dnsmessage.Type(251): true, // IXFR
+	dnsmessage.Type(253): true, // MAILB
+	dnsmessage.Type(254): true, // MAILA
+	dnsmessage.TypeALL:   true,
+}
+
 type Server struct {
 	udpServer net.PacketConn
+	tcpServer net.Listener
+	tcpConns  map[net.Conn]struct{}
+	connMu    sync.Mutex
 	cache     *recordcache.Cache
-	wg        sync.WaitGroup
-	shutdown  context.CancelFunc
-	ctx       context.Context
+	resolver  *resolver.Resolver
+	local     *localrecords.Store // nil without a local records file
+	hosts     *hostsfile.Hosts    // nil without hosts files
+	rpz       *rpz.RPZ            // nil without response policy zones
+	policy    *policy             // for clients in no group
+	policies  map[string]*policy  // by group name
+	lists     []blocklist.List    // every configured list, the downloaded ones are refreshed
+	rules     []*blocklist.Rules  // compiled lists by their index in lists, shared by the policies
+	listsMu   sync.Mutex          // one list reload at a time
+	clients   *clients.Matcher
+	leases    *clients.Leases  // nil without a lease file
+	relays    clients.Networks // trusted to send the Client Subnet of their clients
+	// Safe search endpoints, nil when no client has safe search
+	safeSearch *safesearch.Mapping
+	config     *config.Config
+	wg         sync.WaitGroup
+	shutdown   context.CancelFunc
+	ctx        context.Context
 }
 
 func NewServer(address string) (*Server, error) {
+	return NewServerWithConfig(address, config.Default())
+}
+
+func NewServerWithConfig(address string, cfg *config.Config) (*Server, error) {
+	// A config built by hand skips the checks of config.Load, the UDP buffer needs a floor
+	if cfg.EDNSBufferSize < edns.MinUDPSize {
+		normalized := *cfg
+		normalized.EDNSBufferSize = edns.MinUDPSize
+		cfg = &normalized
+	}
+
+	s := &Server{
+		tcpConns: make(map[net.Conn]struct{}),
+		config:   cfg,
+	}
+
+	// Files first, a broken one should not leave sockets open behind it
+	err := s.loadLocalData()
+	if err != nil {
+		return nil, err
+	}
+
+	// The cache cleans up in the background, it is stopped again when a later step fails
+	s.cache = recordcache.NewCache()
+	s.resolver, err = newResolver(s.cache, cfg)
+	if err != nil {
+		s.cache.Close()
+		return nil, err
+	}
+	err = s.loadPolicies()
+	if err != nil {
+		s.closeCaches()
+		return nil, err
+	}
+
+	s.udpServer, err = net.ListenPacket("udp", address)
+	if err != nil {
+		s.closeCaches()
+		return nil, err
+	}
+
+	// Listen for TCP on the same address, RFC 7766 requires both transports
+	s.tcpServer, err = net.Listen("tcp", address)
+	if err != nil {
+		s.udpServer.Close()
+		s.closeCaches()
+		return nil, err
+	}
+
 	// Create context for shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	udpServer, err := net.ListenPacket("udp", address)
+	s.ctx, s.shutdown = context.WithCancel(context.Background())
+
+	return s, nil
+}
+
+// Build the resolver for the configured mode.
+func newResolver(cache *recordcache.Cache, cfg *config.Config) (*resolver.Resolver, error) {
+	timeout := time.Duration(cfg.UpstreamTimeoutMs) * time.Millisecond
+
+	var r *resolver.Resolver
+	var err error
+	if cfg.Mode == config.ModeForward {
+		r, err = resolver.NewForwardingResolver(cache, cfg.Upstreams, resolver.Strategy(cfg.UpstreamStrategy), timeout)
+	} else {
+		r = resolver.NewResolver(cache)
+		if cfg.RootHintsFile != "" {
+			err = r.LoadRootHints(cfg.RootHintsFile)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{
-		udpServer: udpServer,
-		cache:     recordcache.NewCache(),
-		ctx:       ctx,
-		shutdown:  cancel,
-	}, nil
+	for _, rule := range cfg.ConditionalForwarders {
+		err = r.AddConditionalForwarder(rule.Zone, rule.Servers, rule.SkipDNSSEC, timeout)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Stop the cleanup of the server's caches, groups with upstreams have their own.
+func (s *Server) closeCaches() {
+	for _, p := range s.policies {
+		if p.cache != nil {
+			p.resolver.Close()
+			p.cache.Close()
+		}
+	}
+	s.resolver.Close()
+	s.cache.Close()
 }
 
 // Start the DNS server to listen for queries.
 func (s *Server) Start() {
 	log.Println("Starting DNS server on", s.udpServer.LocalAddr())
 
+	go s.serveTCP()
+	go s.resolver.RunPriming(s.ctx)
+	go s.hosts.Watch(s.ctx)
+	go s.leases.Watch(s.ctx)
+	go s.safeSearch.Watch(s.ctx)
+	go blocklist.Watch(s.ctx, s.lists, s.reloadLists)
+
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -46,7 +172,7 @@ func (s *Server) Start() {
 			log.Println("Server shutting down...")
 			return
 		default:
-			buf := make([]byte, 514)
+			buf := make([]byte, s.config.EDNSBufferSize)
 			n, addr, err := s.udpServer.ReadFrom(buf)
 			if err != nil {
 				if netErr, ok := err.(*net.OpError); ok && netErr.Op == "read" {
@@ -59,7 +185,7 @@ func (s *Server) Start() {
 			}
 
 			s.wg.Add(1)
-			go s.process(addr, buf[:n])
+			go s.process(addr, buf[:n], &udpWriter{conn: s.udpServer, addr: addr, limit: int(s.config.EDNSBufferSize)})
 		}
 	}
 }
@@ -68,9 +194,13 @@ func (s *Server) Start() {
 func (s *Server) Close() {
 	// Signal shutdown and close the UDP server connection
 	s.shutdown()
+	// Stop accepting TCP connections and drop idle ones
+	s.closeTCP()
 	// Wait for all ongoing requests to be processed
 	s.wg.Wait()
 
+	s.closeCaches()
+
 	err := s.udpServer.Close()
 	if err != nil {
 		log.Fatal("Error closing UDP server:", err)
@@ -78,8 +208,8 @@ func (s *Server) Close() {
 	log.Println("Server shut down gracefully")
 }
 
-// Process a single DNS query request.
-func (s *Server) process(addr net.Addr, buf []byte) {
+// Process a single DNS query request and write the reply using w.
+func (s *Server) process(addr net.Addr, buf []byte, w responseWriter) {
 	defer s.wg.Done()
 	rcode := dnsmessage.RCodeSuccess
 	// Parse incoming DNS query
@@ -92,83 +222,95 @@ func (s *Server) process(addr net.Addr, buf []byte) {
 	opcode := msg.Header.OpCode
 	rd := msg.Header.RecursionDesired
 
-	var records []entities.Record
+	// Parse the client's EDNS(0) OPT record, if any
+	var opt *edns.OPT
 	if rcode == dnsmessage.RCodeSuccess {
-		for _, q := range msg.Questions {
-			if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA {
-				nips, err := resolver.ResolveDN(q.Name, msg.Header.ID, q.Type, s.cache)
-				if err != nil {
-					log.Printf("Resolution error from %s for %s: %v", addr, q.Name, err)
+		opt, err = edns.Parse(msg)
+		if err != nil {
+			log.Printf("EDNS error from %s: %v", addr, err)
+			rcode = dnsmessage.RCodeFormatError
+		} else if opt != nil && opt.Version > edns.Version {
+			rcode = edns.RCodeBadVersion
+		}
+	}
 
-					continue
-				}
+	var result entities.Result
+	if rcode == dnsmessage.RCodeSuccess {
+		p := s.policyFor(addr, opt)
+		for i, q := range msg.Questions {
+			if unsupportedTypes[q.Type] {
+				rcode = dnsmessage.RCodeNotImplemented
+				break
+			}
 
-				if len(nips) == 0 {
-					log.Printf("No IP found for %s from %s", q.Name.String(), addr)
-					continue
-				}
+			var res entities.Result
+			if q.Class == dnsmessage.ClassCHAOS {
+				// "dig CH TXT name" tells which rule decides a name
+				res = s.explain(q, p)
+			} else {
+				res, err = s.answer(q, msg.Header.ID, p)
+			}
+			if errors.Is(err, rpz.ErrDrop) {
+				// rpz-drop: the client gets no reply at all and times out
+				log.Printf("Dropped question for %s from %s", q.Name, addr)
+				return
+			}
+			if err != nil {
+				log.Printf("Resolution error from %s for %s: %v", addr, q.Name, err)
+				rcode = dnsmessage.RCodeServerFailure
+				break
+			}
+
+			if res.RCode == dnsmessage.RCodeNameError {
+				log.Printf("%s does not exist, asked by %s", q.Name.String(), addr)
+			} else if res.NoData() {
+				log.Printf("No %s record found for %s from %s", q.Type, q.Name.String(), addr)
+			}
 
-				records = append(records, nips...)
+			if res.RCode != dnsmessage.RCodeSuccess {
+				rcode = res.RCode
 			}
+			result.Answers = append(result.Answers, res.Answers...)
+			result.Authority = append(result.Authority, res.Authority...)
+			// AA only when every answer is local
+			result.Authoritative = res.Authoritative && (i == 0 || result.Authoritative)
+			result.Options = append(result.Options, res.Options...)
 		}
 	}
 
+	if rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+		// Failed replies carry no partial data, only the options explaining them
+		result = entities.Result{Options: result.Options}
+	}
+	result.RCode = rcode
+
 	// Prepare the response message
-	response := s.buildReplyMessage(msg.Header.ID, opcode, rd, rcode, msg.Questions, records)
-	// Pack the response
-	packed, err := response.Pack()
+	response := s.buildReplyMessage(msg.Header.ID, opcode, rd, msg.Questions, result, opt)
+	// Pack the response, trimmed to what the client can receive over this transport.
+	// Records stay cached, so a TCP retry after truncation gets the full answer.
+	packed, err := packResponse(response, w.maxSize(opt))
 	if err != nil {
 		log.Printf("Response packing error for %s: %v", addr, err)
 		return
 	}
 
 	// Send the response back to the client
-	err = s.reply(addr, packed)
+	err = w.write(packed)
 	if err != nil {
 		log.Printf("Error replying to %s: %v", addr, err)
 	}
 }
 
-func (s *Server) reply(addr net.Addr, buf []byte) error {
-	_, err := s.udpServer.WriteTo(buf, addr)
-	return err
-}
-
-func (s *Server) buildReplyMessage(id uint16, opcode dnsmessage.OpCode, rd bool, rcode dnsmessage.RCode, questions []dnsmessage.Question, records []entities.Record) dnsmessage.Message {
+func (s *Server) buildReplyMessage(id uint16, opcode dnsmessage.OpCode, rd bool, questions []dnsmessage.Question, result entities.Result, opt *edns.OPT) dnsmessage.Message {
 	var answers []dnsmessage.Resource
-	if records != nil {
-		// Build DNS answer section
-
-		for _, record := range records {
-			var a dnsmessage.Resource
-			switch record.RType {
-			case dnsmessage.TypeA:
-				a = dnsmessage.Resource{
-					Header: dnsmessage.ResourceHeader{
-						Name:  record.Name,
-						Type:  record.RType,
-						Class: record.Class,
-						TTL:   record.TTL,
-					},
-					Body: &dnsmessage.AResource{
-						A: [4]byte{record.IP[0], record.IP[1], record.IP[2], record.IP[3]},
-					},
-				}
-			case dnsmessage.TypeAAAA:
-				a = dnsmessage.Resource{
-					Header: dnsmessage.ResourceHeader{
-						Name:  record.Name,
-						Type:  record.RType,
-						Class: record.Class,
-						TTL:   record.TTL,
-					},
-					Body: &dnsmessage.AAAAResource{
-						AAAA: [16]byte(record.IP),
-					},
-				}
-			}
-			answers = append(answers, a)
-		}
+	for _, record := range result.Answers {
+		answers = append(answers, record.Resource())
+	}
+
+	// SOA of the zone for negative answers, RFC 2308 section 3
+	var authorities []dnsmessage.Resource
+	for _, record := range result.Authority {
+		authorities = append(authorities, record.Resource())
 	}
 
 	response := dnsmessage.Message{
@@ -176,13 +318,19 @@ func (s *Server) buildReplyMessage(id uint16, opcode dnsmessage.OpCode, rd bool,
 			ID:                 id,
 			Response:           true,
 			OpCode:             opcode,
-			Authoritative:      false, // this server is not supported as an authoritative server
+			Authoritative:      result.Authoritative, // only for local records, everything else is recursion
 			RecursionDesired:   rd,
-			RecursionAvailable: true, // If it supports recursion (RA flag is set), it will perform the necessary queries to resolve www.example.com and return the final IP address to the client - NO OTHER MODE CURRENTLY SUPPORTED
-			RCode:              rcode,
+			RecursionAvailable: true,               // If it supports recursion (RA flag is set), it will perform the necessary queries to resolve www.example.com and return the final IP address to the client - NO OTHER MODE CURRENTLY SUPPORTED
+			RCode:              result.RCode & 0xF, // the upper bits of an extended RCODE travel in the OPT record
 		},
-		Questions: questions,
-		Answers:   answers,
+		Questions:   questions,
+		Answers:     answers,
+		Authorities: authorities,
+	}
+
+	// Only answer with EDNS(0) if the client used it, RFC 6891 section 7
+	if opt != nil {
+		response.Additionals = append(response.Additionals, edns.NewOPT(s.config.EDNSBufferSize, result.RCode, opt.DNSSECOK, result.Options...))
 	}
 
 	return response
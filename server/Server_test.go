@@ -0,0 +1,57 @@
+package server
+
+import (
+	"dnsthingymagik/server/config"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_EDNSBufferSizeFloor(t *testing.T) {
+	cfg := config.Default()
+	cfg.EDNSBufferSize = 0
+	cfg.Mode = config.ModeForward
+	cfg.Upstreams = []string{stubUpstream(t, nil, nil)}
+	s, err := NewServerWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(s.Close)
+
+	if cfg.EDNSBufferSize != 0 {
+		t.Error("Expected the caller's config to be left alone")
+	}
+
+	conn, err := net.Dial("udp", s.udpServer.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 3, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("a.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Header.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 {
+		t.Errorf("Expected an answer, got %s with %d records", reply.Header.RCode, len(reply.Answers))
+	}
+}
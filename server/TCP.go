@@ -0,0 +1,168 @@
+package server
+
+import (
+	"dnsthingymagik/server/edns"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpWriteTimeout = 5 * time.Second
+	tcpMaxInFlight  = 16 // pipelined queries processed concurrently per connection
+)
+
+// RFC 7766 recommends timeouts in the order of seconds, a variable so tests can shorten it
+var tcpIdleTimeout = 10 * time.Second
+
+// responseWriter sends a packed reply back over the transport the query arrived on.
+type responseWriter interface {
+	write(buf []byte) error
+	// maxSize is the largest reply the client accepts on this transport
+	maxSize(opt *edns.OPT) int
+}
+
+type udpWriter struct {
+	conn  net.PacketConn
+	addr  net.Addr
+	limit int // our own EDNS buffer size
+}
+
+func (w *udpWriter) maxSize(opt *edns.OPT) int {
+	return max(min(opt.MaxPayload(), w.limit), edns.MinUDPSize)
+}
+
+func (w *udpWriter) write(buf []byte) error {
+	_, err := w.conn.WriteTo(buf, w.addr)
+	return err
+}
+
+// tcpWriter serializes length-prefixed replies, pipelined queries may finish out of order.
+type tcpWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *tcpWriter) maxSize(*edns.OPT) int {
+	return 0xFFFF
+}
+
+func (w *tcpWriter) write(buf []byte) error {
+	if len(buf) > 0xFFFF {
+		return errors.New("message too large for TCP framing")
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = w.conn.Write(frame)
+	return err
+}
+
+// Accept TCP connections until the listener is closed.
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcpServer.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Error accepting TCP connection:", err)
+			continue
+		}
+
+		s.connMu.Lock()
+		select {
+		case <-s.ctx.Done():
+			s.connMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.tcpConns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connMu.Unlock()
+
+		go s.handleTCP(conn)
+	}
+}
+
+// Read length-prefixed queries from a single connection until it goes idle or is closed.
+func (s *Server) handleTCP(conn net.Conn) {
+	defer s.wg.Done()
+
+	var inflight sync.WaitGroup
+	sem := make(chan struct{}, tcpMaxInFlight)
+	w := &tcpWriter{conn: conn}
+
+	defer func() {
+		// Let pipelined queries finish before the connection goes away
+		inflight.Wait()
+		s.connMu.Lock()
+		delete(s.tcpConns, conn)
+		s.connMu.Unlock()
+		conn.Close()
+	}()
+
+	prefix := make([]byte, 2)
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if err != nil {
+			return
+		}
+
+		_, err = io.ReadFull(conn, prefix)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					log.Printf("Error reading TCP query from %s: %v", conn.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(prefix))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			log.Printf("Error reading TCP query from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		sem <- struct{}{}
+		inflight.Add(1)
+		s.wg.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-sem }()
+			s.process(conn.RemoteAddr(), buf, w)
+		}()
+	}
+}
+
+// Stop accepting connections and unblock readers so idle connections close.
+func (s *Server) closeTCP() {
+	err := s.tcpServer.Close()
+	if err != nil {
+		log.Println("Error closing TCP listener:", err)
+	}
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	for conn := range s.tcpConns {
+		// Expire the pending read, in-flight replies can still be written
+		conn.SetReadDeadline(time.Now())
+	}
+}
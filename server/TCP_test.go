@@ -0,0 +1,211 @@
+package server
+
+import (
+	"dnsthingymagik/server/config"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An upstream answering every A question with 192.0.2.1, after the delay set for the
+// name. The names it is asked go to asked, when set.
+func stubUpstream(t *testing.T, delays map[string]time.Duration, asked chan<- string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				var q dnsmessage.Message
+				if q.Unpack(buf[:n]) != nil || len(q.Questions) != 1 {
+					return
+				}
+				name := strings.ToLower(q.Questions[0].Name.String())
+				if asked != nil {
+					asked <- name
+				}
+				time.Sleep(delays[name])
+
+				reply := dnsmessage.Message{
+					Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+					Questions: q.Questions,
+				}
+				if q.Questions[0].Type == dnsmessage.TypeA {
+					reply.Answers = []dnsmessage.Resource{{
+						Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+					}}
+				}
+				packed, err := reply.Pack()
+				if err == nil {
+					pc.WriteTo(packed, from)
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// Start a server forwarding to upstream on ephemeral loopback ports, the caller closes it.
+func startForwarding(t *testing.T, upstream string) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Mode = config.ModeForward
+	cfg.Upstreams = []string{upstream}
+	s, err := NewServerWithConfig("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	return s
+}
+
+func dialTCP(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.tcpServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// A length-prefixed A query for name.
+func frame(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)
+}
+
+func readReply(t *testing.T, conn net.Conn) dnsmessage.Message {
+	t.Helper()
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		t.Fatalf("Expected a reply, got %v", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(prefix))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Expected the whole reply, got %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		t.Fatalf("Expected a DNS message of the prefixed length, got %v", err)
+	}
+	return msg
+}
+
+func Test_TCPPipelinedOutOfOrder(t *testing.T) {
+	upstream := stubUpstream(t, map[string]time.Duration{"slow.test.": 300 * time.Millisecond}, nil)
+	s := startForwarding(t, upstream)
+	t.Cleanup(s.Close)
+	conn := dialTCP(t, s)
+
+	// Both queries in one write, and the second one split over two more
+	first := frame(t, 1, "slow.test.")
+	second := frame(t, 2, "fast.test.")
+	if _, err := conn.Write(append(first, second[:5]...)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := conn.Write(second[5:]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		id   uint16
+		name string
+	}{{2, "fast.test."}, {1, "slow.test."}} {
+		reply := readReply(t, conn)
+		if reply.Header.ID != want.id || len(reply.Answers) != 1 || reply.Answers[0].Header.Name.String() != want.name {
+			t.Errorf("Expected the answer for %s (id %d), got id %d %v", want.name, want.id, reply.Header.ID, reply.Answers)
+		}
+	}
+}
+
+func Test_TCPIdleTimeout(t *testing.T) {
+	idle := tcpIdleTimeout
+	tcpIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { tcpIdleTimeout = idle })
+
+	s := startForwarding(t, stubUpstream(t, nil, nil))
+	t.Cleanup(s.Close)
+	conn := dialTCP(t, s)
+
+	// Still open while in use
+	if _, err := conn.Write(frame(t, 1, "a.test.")); err != nil {
+		t.Fatal(err)
+	}
+	readReply(t, conn)
+
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected the server to close the idle connection, got %v", err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("Expected the connection to close after about 100ms, took %s", waited)
+	}
+}
+
+func Test_TCPCloseDrainsInFlight(t *testing.T) {
+	asked := make(chan string, 1)
+	upstream := stubUpstream(t, map[string]time.Duration{"slow.test.": 300 * time.Millisecond}, asked)
+	s := startForwarding(t, upstream)
+	conn := dialTCP(t, s)
+
+	if _, err := conn.Write(frame(t, 7, "slow.test.")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-asked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the query to reach the upstream")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	reply := readReply(t, conn)
+	if reply.Header.ID != 7 || len(reply.Answers) != 1 {
+		t.Errorf("Expected the in-flight answer before shutdown, got id %d %v", reply.Header.ID, reply.Answers)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to close after the reply, got %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Close to return once the query was answered")
+	}
+
+	// No new connections after shutdown
+	if conn, err := net.DialTimeout("tcp", s.tcpServer.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Error("Expected the listener to be closed")
+	}
+}
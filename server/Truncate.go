@@ -0,0 +1,83 @@
+package server
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Pack the response into at most limit bytes. Whole RRsets are removed, optional
+// additional data first, and the TC bit is set once required data had to go (RFC 2181 section 9).
+func packResponse(response dnsmessage.Message, limit int) ([]byte, error) {
+	packed, err := response.Pack()
+	if err != nil || len(packed) <= limit {
+		return packed, err
+	}
+
+	// The OPT record must survive truncation so the client still sees our EDNS parameters
+	var opt []dnsmessage.Resource
+	var additionals []dnsmessage.Resource
+	for _, additional := range response.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, additional)
+		} else {
+			additionals = append(additionals, additional)
+		}
+	}
+
+	sets := rrsets(additionals)
+	for len(sets) > 0 {
+		sets = sets[:len(sets)-1]
+		response.Additionals = append(flatten(sets), opt...)
+		packed, err = response.Pack()
+		if err != nil || len(packed) <= limit {
+			return packed, err
+		}
+	}
+
+	response.Header.Truncated = true
+
+	sets = rrsets(response.Authorities)
+	for len(sets) > 0 {
+		sets = sets[:len(sets)-1]
+		response.Authorities = flatten(sets)
+		packed, err = response.Pack()
+		if err != nil || len(packed) <= limit {
+			return packed, err
+		}
+	}
+
+	sets = rrsets(response.Answers)
+	for len(sets) > 0 {
+		sets = sets[:len(sets)-1]
+		response.Answers = flatten(sets)
+		packed, err = response.Pack()
+		if err != nil || len(packed) <= limit {
+			return packed, err
+		}
+	}
+
+	return packed, err
+}
+
+// Group consecutive records sharing owner, type and class into RRsets.
+func rrsets(records []dnsmessage.Resource) [][]dnsmessage.Resource {
+	var sets [][]dnsmessage.Resource
+	for _, record := range records {
+		if n := len(sets); n > 0 {
+			last := sets[n-1][0].Header
+			if last.Name == record.Header.Name && last.Type == record.Header.Type && last.Class == record.Header.Class {
+				sets[n-1] = append(sets[n-1], record)
+				continue
+			}
+		}
+		sets = append(sets, []dnsmessage.Resource{record})
+	}
+	return sets
+}
+
+func flatten(sets [][]dnsmessage.Resource) []dnsmessage.Resource {
+	var records []dnsmessage.Resource
+	for _, set := range sets {
+		records = append(records, set...)
+	}
+	return records
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"dnsthingymagik/server/edns"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"testing"
+)
+
+func txtRecord(name string, text string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.TXTResource{TXT: []string{text}},
+	}
+}
+
+func aRecord(name string, last byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}},
+	}
+}
+
+func Test_PackResponse(t *testing.T) {
+	big := strings.Repeat("x", 200)
+	question := []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}}
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("h.example.com."), MinTTL: 60},
+	}
+
+	tests := []struct {
+		name        string
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		additionals []dnsmessage.Resource
+		limit       int
+		truncated   bool
+		// Records left in each section after packing
+		answerCnt, authorityCnt, additionalCnt int
+	}{
+		{
+			name:      "fits",
+			answers:   []dnsmessage.Resource{txtRecord("example.com.", "short")},
+			limit:     512,
+			answerCnt: 1,
+		},
+		{
+			name:          "additional data goes first, without TC",
+			answers:       []dnsmessage.Resource{txtRecord("example.com.", big)},
+			additionals:   []dnsmessage.Resource{txtRecord("extra.example.com.", big), edns.NewOPT(1232, 0, false)},
+			limit:         300,
+			answerCnt:     1,
+			additionalCnt: 1, // the OPT record stays
+		},
+		{
+			name:          "authority goes next and sets TC",
+			answers:       []dnsmessage.Resource{txtRecord("example.com.", big)},
+			authorities:   []dnsmessage.Resource{soa, txtRecord("example.com.", big)},
+			additionals:   []dnsmessage.Resource{edns.NewOPT(1232, 0, false)},
+			limit:         300,
+			truncated:     true,
+			answerCnt:     1,
+			authorityCnt:  1,
+			additionalCnt: 1,
+		},
+		{
+			name: "answers are cut by whole RRsets",
+			answers: []dnsmessage.Resource{
+				txtRecord("example.com.", big), txtRecord("example.com.", big),
+				aRecord("example.com.", 1), aRecord("example.com.", 2),
+			},
+			limit:     480,
+			truncated: true,
+			answerCnt: 2, // the TXT RRset, both A records go together
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := dnsmessage.Message{
+				Header:      dnsmessage.Header{ID: 1, Response: true},
+				Questions:   question,
+				Answers:     tt.answers,
+				Authorities: tt.authorities,
+				Additionals: tt.additionals,
+			}
+			packed, err := packResponse(response, tt.limit)
+			if err != nil {
+				t.Fatalf("Failed to pack: %v", err)
+			}
+			if len(packed) > tt.limit {
+				t.Errorf("Expected at most %d bytes, got %d", tt.limit, len(packed))
+			}
+
+			var got dnsmessage.Message
+			err = got.Unpack(packed)
+			if err != nil {
+				t.Fatalf("Failed to unpack: %v", err)
+			}
+			if got.Header.Truncated != tt.truncated {
+				t.Errorf("Expected TC=%v, got %v", tt.truncated, got.Header.Truncated)
+			}
+			counts := fmt.Sprint(len(got.Answers), len(got.Authorities), len(got.Additionals))
+			want := fmt.Sprint(tt.answerCnt, tt.authorityCnt, tt.additionalCnt)
+			if counts != want {
+				t.Errorf("Expected answer/authority/additional counts %s, got %s", want, counts)
+			}
+		})
+	}
+}
+
+func Test_RRSets(t *testing.T) {
+	records := []dnsmessage.Resource{
+		aRecord("a.example.", 1), aRecord("a.example.", 2),
+		txtRecord("a.example.", "x"),
+		aRecord("b.example.", 3),
+		aRecord("a.example.", 4), // not next to its set, kept apart
+	}
+	sets := rrsets(records)
+
+	var sizes []int
+	for _, set := range sets {
+		sizes = append(sizes, len(set))
+	}
+	if fmt.Sprint(sizes) != "[2 1 1 1]" {
+		t.Errorf("Expected RRset sizes [2 1 1 1], got %v", sizes)
+	}
+	if len(flatten(sets)) != len(records) {
+		t.Errorf("Expected flatten to give back %d records, got %d", len(records), len(flatten(sets)))
+	}
+}
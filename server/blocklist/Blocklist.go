@@ -0,0 +1,226 @@
+package blocklist
+
+import (
+	"dnsthingymagik/server/schedule"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// List is a block or allow list and how names blocked by it are answered.
+type List struct {
+	Name     string
+	Path     string
+	URL      string        // downloaded to Path, which is read as usual
+	Refresh  time.Duration // how often URL is fetched again, DefaultRefresh when zero
+	Rules    []string      // inline rules, read after the file if there is one
+	Allow    bool          // every rule of the list allows instead of blocking
+	Response string        // one of the Response constants, NXDOMAIN when empty
+	Sinkhole []net.IP      // addresses for ResponseSinkhole
+	TTL      uint32
+	Schedule *schedule.Schedule // nil when the list always applies
+}
+
+// Rule is the list entry that decided a name.
+type Rule struct {
+	Text    string // as written in the list
+	Domain  string // the domain for domain rules, empty for patterns
+	List    *List
+	Allow   bool
+	pattern *regexp.Regexp
+}
+
+// Blocklist matches names against the rules of its lists. The first kind of rule that
+// matches decides, in this order:
+//
+//  1. allowed domains, each covering its subdomains
+//  2. allow regexes and globs
+//  3. block regexes and globs
+//  4. blocked domains
+//
+// Explicit patterns are checked before the bulk domain lists so a handwritten rule
+// is never shadowed by a downloaded one. Among domains the most specific one decides,
+// whichever list has it. Lists with a schedule only take part while it is active.
+type Blocklist struct {
+	lists []*Rules
+}
+
+// Rules are the compiled rules of one list. They do not change once compiled, so
+// blocklists of different groups share them.
+type Rules struct {
+	list     List
+	allowed  trie
+	allowPat []*Rule
+	blockPat []*Rule
+	blocked  trie
+}
+
+const levels = 4 // kinds of rules, in order of precedence
+
+// New combines compiled lists into one matcher, earlier lists win ties.
+func New(lists ...*Rules) *Blocklist {
+	return &Blocklist{lists: lists}
+}
+
+// Load compiles the lists into one matcher. A list that cannot be read fails the load.
+func Load(lists []List) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, list := range lists {
+		rules, err := Compile(list)
+		if err != nil {
+			return nil, err
+		}
+		b.lists = append(b.lists, rules)
+	}
+	return b, nil
+}
+
+// Compile reads the rules of a list from its file and inline rules.
+func Compile(list List) (*Rules, error) {
+	if list.Name == "" {
+		list.Name = list.Path
+	}
+	if list.TTL == 0 {
+		list.TTL = DefaultTTL
+	}
+	r := &Rules{list: list}
+
+	var sources []io.Reader
+	if list.Path != "" {
+		file, err := os.Open(list.Path)
+		switch {
+		case err == nil:
+			defer file.Close()
+			sources = append(sources, file)
+		case list.URL != "" && os.IsNotExist(err):
+			// Never downloaded yet, the next refresh brings the rules
+			log.Printf("List %s has no copy of %s yet", list.Name, list.URL)
+		default:
+			return nil, err
+		}
+	}
+	if len(list.Rules) > 0 {
+		// The file may not end in a newline, the first rule must not join its last line
+		sources = append(sources, strings.NewReader("\n"+strings.Join(list.Rules, "\n")))
+	}
+
+	count := 0
+	skipped, err := parse(io.MultiReader(sources...), func(e entry) {
+		count++
+		r.insert(e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("List %s: %d rules, %d lines skipped", list.Name, count, skipped)
+	return r, nil
+}
+
+func (r *Rules) insert(e entry) {
+	rule := &Rule{Text: e.text, Domain: e.domain, List: &r.list, Allow: e.allow || r.list.Allow, pattern: e.pattern}
+	switch {
+	case rule.pattern != nil && rule.Allow:
+		r.allowPat = append(r.allowPat, rule)
+	case rule.pattern != nil:
+		r.blockPat = append(r.blockPat, rule)
+	case rule.Allow:
+		r.allowed.insert(rule.Domain, rule)
+	default:
+		r.blocked.insert(rule.Domain, rule)
+	}
+}
+
+// Match returns the rule deciding name at now, nil when no rule matches. A rule with
+// Allow set means the name is resolved even though a blocklist may have it.
+// The decision holds until the returned time, when a schedule with a rule for the
+// name flips; it is zero when no schedule is involved.
+func (b *Blocklist) Match(name dnsmessage.Name, now time.Time) (*Rule, time.Time) {
+	if b == nil {
+		return nil, time.Time{}
+	}
+
+	domain := normalize(name.String())
+	var decided *Rule
+	var until time.Time
+	for level := 0; level < levels && decided == nil; level++ {
+		depth := -1
+		for _, r := range b.lists {
+			rule, labels := r.match(level, domain)
+			if rule == nil {
+				continue
+			}
+			if sched := r.list.Schedule; sched != nil {
+				// Active or not, this rule decides once its schedule flips
+				next := sched.NextChange(now)
+				if until.IsZero() || (!next.IsZero() && next.Before(until)) {
+					until = next
+				}
+				if !sched.Active(now) {
+					continue
+				}
+			}
+			// The most specific domain wins, the first list loaded on a tie
+			if labels > depth {
+				decided, depth = rule, labels
+			}
+		}
+	}
+	return decided, until
+}
+
+// Blocked returns the rule blocking name at now, nil when it is resolved as usual,
+// and until when that holds as Match does.
+func (b *Blocklist) Blocked(name dnsmessage.Name, now time.Time) (*Rule, time.Time) {
+	rule, until := b.Match(name, now)
+	if rule != nil && rule.Allow {
+		return nil, until
+	}
+	return rule, until
+}
+
+// Rule of the given kind matching domain, with the labels of its listed domain; patterns
+// count as zero labels.
+func (r *Rules) match(level int, domain string) (*Rule, int) {
+	switch level {
+	case 0:
+		return r.allowed.match(domain)
+	case 1:
+		return matchPattern(r.allowPat, domain), 0
+	case 2:
+		return matchPattern(r.blockPat, domain), 0
+	default:
+		return r.blocked.match(domain)
+	}
+}
+
+func matchPattern(rules []*Rule, domain string) *Rule {
+	for _, rule := range rules {
+		if rule.pattern.MatchString(domain) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Rule) String() string {
+	return fmt.Sprintf("%s (%s)", r.Text, r.List.Name)
+}
+
+// Explain describes the decision for a name, for humans.
+func (r *Rule) Explain() string {
+	if r == nil {
+		return "not on any list"
+	}
+	action := "blocked"
+	if r.Allow {
+		action = "allowed"
+	}
+	return fmt.Sprintf("%s by rule %q of list %s", action, r.Text, r.List.Name)
+}
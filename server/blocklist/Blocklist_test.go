@@ -0,0 +1,88 @@
+package blocklist
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Match(t *testing.T) {
+	b, err := Load([]List{
+		{Name: "ads", Rules: []string{"example.com", "tracker.net", "deep.sub.tracker.net"}},
+		{Name: "more", Rules: []string{"ads.example.com", "example.com", "sub.tracker.net"}},
+		{Name: "allow", Allow: true, Rules: []string{"ok.ads.example.com"}},
+		{Name: "patterns", Rules: []string{"/^pat\\./", "@@||free.tracker.net^"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rule string // "" when nothing matches
+		list string
+	}{
+		{name: "example.com.", rule: "example.com", list: "ads"}, // on both, the first list wins
+		{name: "www.example.com.", rule: "example.com", list: "ads"},
+		// A subdomain on another list is not lost under its parent
+		{name: "ads.example.com.", rule: "ads.example.com", list: "more"},
+		{name: "x.ads.example.com.", rule: "ads.example.com", list: "more"},
+		{name: "sub.tracker.net.", rule: "sub.tracker.net", list: "more"},
+		{name: "x.deep.sub.tracker.net.", rule: "deep.sub.tracker.net", list: "ads"},
+		// Allowed domains come first, then patterns, whatever the depth
+		{name: "ok.ads.example.com.", rule: "ok.ads.example.com", list: "allow"},
+		{name: "pat.example.com.", rule: "/^pat\\./", list: "patterns"},
+		{name: "x.free.tracker.net.", rule: "@@||free.tracker.net^", list: "patterns"},
+		{name: "example.org.", rule: ""},
+	}
+
+	for _, tt := range tests {
+		rule, until := b.Match(dnsmessage.MustNewName(tt.name), time.Now())
+		if !until.IsZero() {
+			t.Errorf("%s: expected no schedule, got %s", tt.name, until)
+		}
+		if tt.rule == "" {
+			if rule != nil {
+				t.Errorf("%s: expected no rule, got %s", tt.name, rule)
+			}
+			continue
+		}
+		if rule == nil || rule.Text != tt.rule || rule.List.Name != tt.list {
+			t.Errorf("%s: expected %s (%s), got %v", tt.name, tt.rule, tt.list, rule)
+		}
+	}
+}
+
+func Test_TrieKeepsSubdomains(t *testing.T) {
+	var tr trie
+	parent, child := &Rule{Text: "parent"}, &Rule{Text: "child"}
+	tr.insert("b.example", child)
+	tr.insert("example", parent)
+
+	tests := map[string]*Rule{"example": parent, "a.example": parent, "b.example": child, "c.b.example": child, "other": nil}
+	for domain, want := range tests {
+		if got, _ := tr.match(domain); got != want {
+			t.Errorf("%s: expected %v, got %v", domain, want, got)
+		}
+	}
+}
+
+func Test_FileAndRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	// No newline at the end of the file
+	if err := os.WriteFile(path, []byte("one.example\ntwo.example"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Load([]List{{Name: "mixed", Path: path, Rules: []string{"three.example"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"one.example.", "two.example.", "three.example."} {
+		if rule, _ := b.Blocked(dnsmessage.MustNewName(name), time.Now()); rule == nil {
+			t.Errorf("Expected %s to be blocked", name)
+		}
+	}
+}
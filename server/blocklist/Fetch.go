@@ -0,0 +1,196 @@
+package blocklist
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRefresh = 24 * time.Hour
+	fetchTimeout   = 30 * time.Second
+	prefetchBudget = 10 * time.Second // startup waits this long for all lists together
+)
+
+// What the server said about the copy on disk, sent back so only changes are downloaded.
+// Kept next to the copy in <path>.meta.
+type validators struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// Fetch downloads the list's URL to its path and reports whether the copy there changed.
+// A copy the server says is current (304) is kept, as is the old copy on any error or
+// when the download has no rules at all.
+func Fetch(ctx context.Context, list List) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, list.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	// Conditional only when there is a copy to fall back on
+	if _, err := os.Stat(list.Path); err == nil {
+		saved := readValidators(list.Path)
+		if saved.ETag != "" {
+			req.Header.Set("If-None-Match", saved.ETag)
+		}
+		if saved.LastModified != "" {
+			req.Header.Set("If-Modified-Since", saved.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("%s: %s", list.URL, resp.Status)
+	}
+
+	// Download next to the copy and rename over it, a broken transfer leaves the old one
+	tmp, err := os.CreateTemp(filepath.Dir(list.Path), filepath.Base(list.Path)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	err = checkRules(tmp.Name())
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", list.URL, err)
+	}
+	err = os.Rename(tmp.Name(), list.Path)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeValidators(list.Path, validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		// Only costs a full download next time
+		log.Printf("List %s: %v", list.URL, err)
+	}
+	return true, nil
+}
+
+// A download that is an error page or cut short parses to nothing, the copy it would
+// replace is better than an empty list.
+func checkRules(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count := 0
+	_, err = parse(file, func(entry) { count++ })
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no rules in the download")
+	}
+	return nil
+}
+
+// Prefetch downloads every list with a URL at once, for startup, and gives up on the
+// slow ones after prefetchBudget. An unreachable source leaves the copy from an earlier
+// run, the next refresh tries again.
+func Prefetch(lists []List) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchBudget)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, list := range lists {
+		if list.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Fetch(ctx, list)
+			if err != nil {
+				log.Printf("List %s unreachable, using the copy in %s: %v", cmp.Or(list.Name, list.URL), list.Path, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Watch fetches every list with a URL on its refresh interval until ctx is done, and
+// calls changed after a list's copy was replaced.
+func Watch(ctx context.Context, lists []List, changed func(List)) {
+	var wg sync.WaitGroup
+	for _, list := range lists {
+		if list.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refresh(ctx, list, changed)
+		}()
+	}
+	wg.Wait()
+}
+
+func refresh(ctx context.Context, list List, changed func(List)) {
+	ticker := time.NewTicker(cmp.Or(list.Refresh, DefaultRefresh))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+		updated, err := Fetch(fetchCtx, list)
+		cancel()
+		if err != nil {
+			log.Printf("List %s refresh error, keeping the old rules: %v", cmp.Or(list.Name, list.URL), err)
+			continue
+		}
+		if updated {
+			changed(list)
+		}
+	}
+}
+
+func readValidators(path string) validators {
+	var saved validators
+	data, err := os.ReadFile(path + ".meta")
+	if err == nil {
+		// A broken file just means a full download
+		_ = json.Unmarshal(data, &saved)
+	}
+	return saved
+}
+
+func writeValidators(path string, saved validators) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".meta", data, 0644)
+}
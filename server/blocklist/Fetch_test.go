@@ -0,0 +1,242 @@
+package blocklist
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A list source answering conditional requests with its current version as the ETag.
+// The status of every response goes to served, unless it is nil or full.
+type listSource struct {
+	mu          sync.Mutex
+	body        string
+	version     int
+	notModified int
+	served      chan int
+}
+
+func (l *listSource) set(body string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.body = body
+	l.version++
+}
+
+func (l *listSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := http.StatusOK
+	defer func() {
+		select {
+		case l.served <- status:
+		default:
+		}
+	}()
+
+	etag := fmt.Sprintf("\"v%d\"", l.version)
+	if r.Header.Get("If-None-Match") == etag {
+		l.notModified++
+		status = http.StatusNotModified
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, l.body)
+}
+
+func blocked(t *testing.T, list List, name string) bool {
+	t.Helper()
+	b, err := Load([]List{list})
+	if err != nil {
+		t.Fatalf("Failed to load list: %v", err)
+	}
+	rule, _ := b.Blocked(dnsmessage.MustNewName(name), time.Now())
+	return rule != nil
+}
+
+func Test_ConditionalFetch(t *testing.T) {
+	source := &listSource{}
+	source.set("ads.example.com\n")
+	web := httptest.NewServer(source)
+	defer web.Close()
+
+	list := List{Name: "remote", URL: web.URL, Path: filepath.Join(t.TempDir(), "remote.txt")}
+	ctx := context.Background()
+
+	changed, err := Fetch(ctx, list)
+	if err != nil || !changed {
+		t.Fatalf("Expected the first fetch to download the list, got changed=%v err=%v", changed, err)
+	}
+	if !blocked(t, list, "ads.example.com.") {
+		t.Error("Expected ads.example.com to be blocked by the downloaded list")
+	}
+
+	// Same version, the server answers 304 and the copy stays
+	changed, err = Fetch(ctx, list)
+	if err != nil || changed {
+		t.Fatalf("Expected an unchanged list, got changed=%v err=%v", changed, err)
+	}
+	source.mu.Lock()
+	if source.notModified != 1 {
+		t.Errorf("Expected one 304 response, got %d", source.notModified)
+	}
+	source.mu.Unlock()
+
+	source.set("tracker.example.com\n")
+	changed, err = Fetch(ctx, list)
+	if err != nil || !changed {
+		t.Fatalf("Expected the new version to be downloaded, got changed=%v err=%v", changed, err)
+	}
+	if blocked(t, list, "ads.example.com.") || !blocked(t, list, "tracker.example.com.") {
+		t.Error("Expected only tracker.example.com to be blocked after the update")
+	}
+
+	// Source gone, the copy on disk is still used
+	web.Close()
+	_, err = Fetch(ctx, list)
+	if err == nil {
+		t.Error("Expected an error from an unreachable source")
+	}
+	if !blocked(t, list, "tracker.example.com.") {
+		t.Error("Expected the copy on disk to keep blocking tracker.example.com")
+	}
+}
+
+func Test_FetchRefusesEmptyDownload(t *testing.T) {
+	source := &listSource{}
+	source.set("ads.example.com\n")
+	web := httptest.NewServer(source)
+	defer web.Close()
+
+	list := List{Name: "remote", URL: web.URL, Path: filepath.Join(t.TempDir(), "remote.txt")}
+	if _, err := Fetch(context.Background(), list); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"", "# only a comment\n", "<html><body>Maintenance</body></html>\n"} {
+		source.set(body)
+		changed, err := Fetch(context.Background(), list)
+		if err == nil || changed {
+			t.Errorf("%q: expected the download to be refused, got changed=%v err=%v", body, changed, err)
+		}
+		if !blocked(t, list, "ads.example.com.") {
+			t.Errorf("%q: expected the old copy to stay", body)
+		}
+	}
+
+	// Nothing left behind next to the copy
+	entries, err := os.ReadDir(filepath.Dir(list.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != "remote.txt" && name != "remote.txt.meta" {
+			t.Errorf("Expected no temporary files, found %s", name)
+		}
+	}
+}
+
+func Test_MissingCopy(t *testing.T) {
+	list := List{Name: "remote", URL: "http://127.0.0.1:1/list", Path: filepath.Join(t.TempDir(), "remote.txt"), Rules: []string{"inline.example.com"}}
+	Prefetch([]List{list})
+
+	if _, err := os.Stat(list.Path); err == nil {
+		t.Fatal("Expected no copy from an unreachable source")
+	}
+	// Loads with the inline rules until the source is reachable
+	if !blocked(t, list, "inline.example.com.") {
+		t.Error("Expected the inline rule to block without a downloaded copy")
+	}
+}
+
+func Test_PrefetchAtOnce(t *testing.T) {
+	// Each source only answers once both were asked, one after the other they would time out
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	both := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(both)
+	}()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		select {
+		case <-both:
+			fmt.Fprintln(w, "ads.example.com")
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	first, second := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer first.Close()
+	defer second.Close()
+
+	dir := t.TempDir()
+	lists := []List{
+		{Name: "first", URL: first.URL, Path: filepath.Join(dir, "first.txt")},
+		{Name: "inline", Rules: []string{"inline.example.com"}},
+		{Name: "second", URL: second.URL, Path: filepath.Join(dir, "second.txt")},
+	}
+	Prefetch(lists)
+
+	for _, list := range []List{lists[0], lists[2]} {
+		if !blocked(t, list, "ads.example.com.") {
+			t.Errorf("Expected %s to be downloaded", list.Name)
+		}
+	}
+}
+
+func Test_WatchRefreshes(t *testing.T) {
+	source := &listSource{}
+	source.set("ads.example.com\n")
+	web := httptest.NewServer(source)
+	defer web.Close()
+
+	list := List{Name: "remote", URL: web.URL, Path: filepath.Join(t.TempDir(), "remote.txt"), Refresh: 20 * time.Millisecond}
+	Prefetch([]List{list})
+
+	source.mu.Lock()
+	source.served = make(chan int, 100)
+	source.mu.Unlock()
+	changes := make(chan List, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, []List{list}, func(l List) { changes <- l })
+
+	// Nothing changed yet, refreshes only get 304s
+	for i := 0; i < 2; i++ {
+		select {
+		case status := <-source.served:
+			if status != http.StatusNotModified {
+				t.Fatalf("Expected a 304 before the list is updated, got %d", status)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the list to be refreshed")
+		}
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Expected no change before the list is updated, got %d", len(changes))
+	}
+
+	source.set("tracker.example.com\n")
+	select {
+	case changed := <-changes:
+		if changed.Name != "remote" {
+			t.Errorf("Expected the remote list to change, got %q", changed.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the update to be noticed by a refresh")
+	}
+	if !blocked(t, list, "tracker.example.com.") {
+		t.Error("Expected tracker.example.com to be blocked after the refresh")
+	}
+}
@@ -0,0 +1,184 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Names hosts files map to themselves, never worth blocking
+var hostsBoilerplate = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// One rule of a list: a domain covering itself and its subdomains, or a pattern.
+type entry struct {
+	text    string         // as written, for explaining decisions
+	domain  string         // set for domain rules
+	pattern *regexp.Regexp // set for regex and glob rules
+	allow   bool           // @@ exception
+}
+
+// Read the rules of a list, the format is detected per line:
+//
+//	0.0.0.0 ads.example.com     hosts file, any address
+//	ads.example.com             plain domain
+//	ads*.example.com            glob, * and ? match any characters, dots included
+//	/^ad[0-9]+\./               regular expression
+//	||ads.example.com^          AdBlock rule, only the domain anchored form
+//	@@||cdn.example.com^        AdBlock exception, allows the domain
+//
+// Comments start with #, ! or [. Lines that are none of the above are counted as skipped.
+func parse(r io.Reader, add func(entry)) (skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		entries, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		for _, e := range entries {
+			add(e)
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+func parseLine(line string) ([]entry, error) {
+	// A regex may contain #, so it is taken whole
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		re, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			return nil, err
+		}
+		return []entry{{text: line, pattern: re}}, nil
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+
+	if rule, ok := strings.CutPrefix(line, "@@"); ok {
+		entries, err := parseAdblock(rule)
+		if err != nil {
+			return nil, err
+		}
+		entries[0].text, entries[0].allow = line, true
+		return entries, nil
+	}
+	if strings.HasPrefix(line, "||") {
+		return parseAdblock(line)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		e, err := parseDomain(fields[0], false)
+		if err != nil {
+			return nil, err
+		}
+		return []entry{e}, nil
+	}
+
+	if net.ParseIP(fields[0]) == nil {
+		return nil, fmt.Errorf("not a rule: %q", line)
+	}
+	var entries []entry
+	for _, host := range fields[1:] {
+		host = normalize(host)
+		if hostsBoilerplate[host] || !validDomain(host) {
+			continue
+		}
+		entries = append(entries, entry{text: host, domain: host})
+	}
+	return entries, nil
+}
+
+// ||domain^ with optional $modifiers, a glob domain keeps the subdomain anchoring.
+func parseAdblock(line string) ([]entry, error) {
+	rule, ok := strings.CutPrefix(line, "||")
+	if !ok {
+		return nil, fmt.Errorf("not a rule: %q", line)
+	}
+	// Modifiers like $third-party are about browsers, a DNS server cannot honour them
+	rule, _, _ = strings.Cut(rule, "$")
+	domain, ok := strings.CutSuffix(rule, "^")
+	if !ok {
+		return nil, fmt.Errorf("not a domain rule: %q", line)
+	}
+
+	e, err := parseDomain(domain, true)
+	if err != nil {
+		return nil, err
+	}
+	e.text = line
+	return []entry{e}, nil
+}
+
+// A plain domain, or a glob when it has wildcards. subdomains makes the glob match
+// below the name as well, like || does.
+func parseDomain(domain string, subdomains bool) (entry, error) {
+	if !strings.ContainsAny(domain, "*?") {
+		if !validDomain(domain) {
+			return entry{}, fmt.Errorf("not a domain: %q", domain)
+		}
+		return entry{text: domain, domain: normalize(domain)}, nil
+	}
+
+	if !validDomain(strings.NewReplacer("*", "a", "?", "a").Replace(domain)) {
+		return entry{}, fmt.Errorf("not a glob: %q", domain)
+	}
+	expr := regexp.QuoteMeta(normalize(domain))
+	expr = strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(expr)
+	if subdomains {
+		expr = `(^|\.)` + expr + `$`
+	} else {
+		expr = `^` + expr + `$`
+	}
+	return entry{text: domain, pattern: regexp.MustCompile(expr)}, nil
+}
+
+// Lower case without the trailing dot, the form names are kept in.
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// Host names as they appear in lists: letters, digits, - and _, dot separated labels.
+// Anything else (paths, URLs) is not a domain rule.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
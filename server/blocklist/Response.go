@@ -0,0 +1,115 @@
+package blocklist
+
+import (
+	"dnsthingymagik/server/edns"
+	"dnsthingymagik/server/resolver/entities"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+)
+
+// What a blocked question is answered with.
+const (
+	ResponseNXDomain = "nxdomain"
+	ResponseNoData   = "nodata"
+	ResponseRefused  = "refused"
+	ResponseNull     = "null"     // 0.0.0.0 and ::
+	ResponseSinkhole = "sinkhole" // the list's own addresses
+
+	DefaultTTL = 60
+)
+
+// ParseSinkhole checks a response mode and the sinkhole addresses that go with it.
+func ParseSinkhole(response string, addrs []string) ([]net.IP, error) {
+	switch response {
+	case "", ResponseNXDomain, ResponseNoData, ResponseRefused, ResponseNull:
+		if len(addrs) > 0 {
+			return nil, fmt.Errorf("sinkhole addresses need response %q", ResponseSinkhole)
+		}
+		return nil, nil
+	case ResponseSinkhole:
+	default:
+		return nil, fmt.Errorf("unknown block response %q", response)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("response %q needs sinkhole addresses", ResponseSinkhole)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid sinkhole address %q", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Answer for a question blocked by this rule, carrying an Extended DNS Error "Blocked".
+// Negative answers get an SOA for the blocked domain so clients cache them for the list's TTL.
+func (r *Rule) Answer(name dnsmessage.Name, rtype dnsmessage.Type) entities.Result {
+	list := r.List
+	result := entities.Result{
+		RCode:   dnsmessage.RCodeSuccess,
+		Options: []dnsmessage.Option{edns.ExtendedError(edns.EDEBlocked, "blocked by "+list.Name)},
+	}
+
+	var addrs []net.IP
+	switch list.Response {
+	case ResponseRefused:
+		result.RCode = dnsmessage.RCodeRefused
+		return result
+	case ResponseNull:
+		addrs = []net.IP{net.IPv4zero, net.IPv6zero}
+	case ResponseSinkhole:
+		addrs = list.Sinkhole
+	case ResponseNoData:
+	default:
+		result.RCode = dnsmessage.RCodeNameError
+	}
+
+	header := dnsmessage.ResourceHeader{Name: name, Type: rtype, Class: dnsmessage.ClassINET, TTL: list.TTL}
+	for _, ip := range addrs {
+		var body dnsmessage.ResourceBody
+		switch {
+		case rtype == dnsmessage.TypeA && ip.To4() != nil:
+			body = &dnsmessage.AResource{A: [4]byte(ip.To4())}
+		case rtype == dnsmessage.TypeAAAA && ip.To4() == nil:
+			body = &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}
+		default:
+			continue
+		}
+		result.Answers = append(result.Answers, entities.NewRecord(dnsmessage.Resource{Header: header, Body: body}))
+	}
+
+	if len(result.Answers) == 0 {
+		result.Authority = []entities.Record{r.soa(name)}
+	}
+	return result
+}
+
+// Made up SOA at the blocked domain, or at the name for pattern rules. Its TTL and
+// minimum are the list's TTL (RFC 2308 section 5).
+func (r *Rule) soa(name dnsmessage.Name) entities.Record {
+	if r.Domain != "" {
+		name = dnsmessage.MustNewName(r.Domain + ".")
+	}
+	return entities.NewRecord(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   r.List.TTL,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("blocked.invalid."),
+			MBox:    dnsmessage.MustNewName("nobody.invalid."),
+			Serial:  1,
+			Refresh: r.List.TTL,
+			Retry:   r.List.TTL,
+			Expire:  r.List.TTL,
+			MinTTL:  r.List.TTL,
+		},
+	})
+}
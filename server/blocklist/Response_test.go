@@ -0,0 +1,109 @@
+package blocklist
+
+import (
+	"dnsthingymagik/server/edns"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Answer(t *testing.T) {
+	both := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")}
+	v4 := []net.IP{net.ParseIP("192.0.2.1")}
+	a, aaaa, mx := dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeMX
+
+	tests := []struct {
+		name     string
+		response string
+		sinkhole []net.IP
+		rtype    dnsmessage.Type
+		rcode    dnsmessage.RCode
+		answers  string // addresses, comma separated
+		soa      bool
+	}{
+		{name: "default is NXDOMAIN", rtype: a, rcode: dnsmessage.RCodeNameError, soa: true},
+		{name: "nxdomain", response: ResponseNXDomain, rtype: aaaa, rcode: dnsmessage.RCodeNameError, soa: true},
+		{name: "nodata", response: ResponseNoData, rtype: a, rcode: dnsmessage.RCodeSuccess, soa: true},
+		{name: "refused", response: ResponseRefused, rtype: a, rcode: dnsmessage.RCodeRefused},
+		{name: "null A", response: ResponseNull, rtype: a, answers: "0.0.0.0"},
+		{name: "null AAAA", response: ResponseNull, rtype: aaaa, answers: "::"},
+		{name: "null for another type is NODATA", response: ResponseNull, rtype: mx, soa: true},
+		{name: "sinkhole A takes the IPv4 addresses", response: ResponseSinkhole, sinkhole: both, rtype: a, answers: "192.0.2.1,192.0.2.2"},
+		{name: "sinkhole AAAA takes the IPv6 addresses", response: ResponseSinkhole, sinkhole: both, rtype: aaaa, answers: "2001:db8::1"},
+		{name: "sinkhole without the family is NODATA", response: ResponseSinkhole, sinkhole: v4, rtype: aaaa, soa: true},
+	}
+
+	for _, tt := range tests {
+		rule := &Rule{
+			Text:   "ads.example.com",
+			Domain: "ads.example.com",
+			List:   &List{Name: "ads", Response: tt.response, Sinkhole: tt.sinkhole, TTL: 120},
+		}
+		result := rule.Answer(dnsmessage.MustNewName("www.ads.example.com."), tt.rtype)
+
+		if result.RCode != tt.rcode {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.rcode, result.RCode)
+		}
+		var answers []string
+		for _, record := range result.Answers {
+			if record.Name.String() != "www.ads.example.com." || record.RType != tt.rtype || record.TTL != 120 {
+				t.Errorf("%s: expected records for the question with the list's TTL, got %s %s %d", tt.name, record.Name, record.RType, record.TTL)
+			}
+			answers = append(answers, record.IP().String())
+		}
+		if got := strings.Join(answers, ","); got != tt.answers {
+			t.Errorf("%s: expected answers %q, got %q", tt.name, tt.answers, got)
+		}
+
+		if !tt.soa {
+			if len(result.Authority) != 0 {
+				t.Errorf("%s: expected no authority, got %v", tt.name, result.Authority)
+			}
+		} else if len(result.Authority) != 1 {
+			t.Errorf("%s: expected an SOA, got %v", tt.name, result.Authority)
+		} else {
+			soa, ok := result.Authority[0].Body.(*dnsmessage.SOAResource)
+			if !ok || result.Authority[0].Name.String() != "ads.example.com." || result.Authority[0].TTL != 120 || soa.MinTTL != 120 {
+				t.Errorf("%s: expected an SOA at the blocked domain with the list's TTL, got %+v", tt.name, result.Authority[0])
+			}
+		}
+
+		if len(result.Options) != 1 || result.Options[0].Code != edns.OptionCodeEDE || !strings.Contains(string(result.Options[0].Data[2:]), "ads") {
+			t.Errorf("%s: expected an Extended DNS Error naming the list, got %+v", tt.name, result.Options)
+		}
+	}
+}
+
+func Test_AnswerPatternSOA(t *testing.T) {
+	rule := &Rule{Text: "/^ads\\./", List: &List{Name: "patterns", TTL: 30}}
+	result := rule.Answer(dnsmessage.MustNewName("ads.example.org."), dnsmessage.TypeA)
+	if len(result.Authority) != 1 || result.Authority[0].Name.String() != "ads.example.org." || result.Authority[0].TTL != 30 {
+		t.Errorf("Expected an SOA at the question name for a pattern rule, got %+v", result.Authority)
+	}
+}
+
+func Test_ParseSinkhole(t *testing.T) {
+	tests := []struct {
+		response string
+		addrs    []string
+		ok       bool
+	}{
+		{response: "", ok: true},
+		{response: ResponseNull, ok: true},
+		{response: ResponseSinkhole, addrs: []string{"192.0.2.1", "2001:db8::1"}, ok: true},
+		{response: ResponseSinkhole},
+		{response: ResponseSinkhole, addrs: []string{"not-an-ip"}},
+		{response: ResponseNXDomain, addrs: []string{"192.0.2.1"}},
+		{response: "drop"},
+	}
+	for _, tt := range tests {
+		ips, err := ParseSinkhole(tt.response, tt.addrs)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q %v: expected ok=%v, got %v", tt.response, tt.addrs, tt.ok, err)
+		}
+		if err == nil && len(ips) != len(tt.addrs) {
+			t.Errorf("%q %v: expected %d addresses, got %v", tt.response, tt.addrs, len(tt.addrs), ips)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package blocklist
+
+import "strings"
+
+// trie stores domains label by label from the root down, so a name is
+// matched against itself and all its parents in one walk.
+type trie struct {
+	root node
+}
+
+type node struct {
+	children map[string]*node
+	rule     *Rule // set when this domain is on a list itself
+}
+
+func (t *trie) insert(domain string, rule *Rule) {
+	n := &t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			child = &node{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+
+	// Listed parents stay beside their subdomains, the deepest one decides a name
+	if n.rule == nil {
+		n.rule = rule
+	}
+}
+
+// Rule of domain itself or of its closest listed parent, and the number of labels of
+// the listed domain.
+func (t *trie) match(domain string) (*Rule, int) {
+	var rule *Rule
+	var depth int
+	n := &t.root
+	for labels := 1; domain != ""; labels++ {
+		var label string
+		if i := strings.LastIndexByte(domain, '.'); i >= 0 {
+			label, domain = domain[i+1:], domain[:i]
+		} else {
+			label, domain = domain, ""
+		}
+
+		n = n.children[label]
+		if n == nil {
+			break
+		}
+		if n.rule != nil {
+			rule, depth = n.rule, labels
+		}
+	}
+	return rule, depth
+}
@@ -0,0 +1,112 @@
+package clients
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Group is a named set of clients, given by address, network or MAC address.
+type Group struct {
+	Name    string
+	Clients []string
+}
+
+type matcherGroup struct {
+	name string
+	nets Networks
+	macs map[string]bool
+}
+
+// Matcher finds the group of a client, the first group listing it wins.
+type Matcher struct {
+	groups []matcherGroup
+	leases *Leases // maps addresses to MACs, nil without a lease file
+}
+
+// NewMatcher parses the client entries of the groups, leases may be nil.
+func NewMatcher(groups []Group, leases *Leases) (*Matcher, error) {
+	m := &Matcher{leases: leases}
+	for _, group := range groups {
+		g := matcherGroup{name: group.Name, macs: make(map[string]bool)}
+		for _, client := range group.Clients {
+			if mac, err := net.ParseMAC(client); err == nil {
+				g.macs[mac.String()] = true
+				continue
+			}
+
+			network, err := parseNetwork(client)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: client %q is not an address, network or MAC", group.Name, client)
+			}
+			g.nets = append(g.nets, network)
+		}
+		if len(g.macs) > 0 && leases == nil {
+			return nil, fmt.Errorf("group %s: MAC addresses need a lease file", group.Name)
+		}
+		m.groups = append(m.groups, g)
+	}
+	return m, nil
+}
+
+// An address is a network of one.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an address or network", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Networks is a set of addresses and networks.
+type Networks []*net.IPNet
+
+// ParseNetworks parses addresses and CIDR networks.
+func ParseNetworks(entries []string) (Networks, error) {
+	var networks Networks
+	for _, entry := range entries {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains reports whether ip is in any of the networks.
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Group returns the name of the group ip belongs to, "" when it is in none.
+func (m *Matcher) Group(ip net.IP) string {
+	if m == nil || ip == nil {
+		return ""
+	}
+
+	var mac string
+	if m.leases != nil {
+		mac = m.leases.MAC(ip)
+	}
+
+	for _, g := range m.groups {
+		if (mac != "" && g.macs[mac]) || g.nets.Contains(ip) {
+			return g.name
+		}
+	}
+	return ""
+}
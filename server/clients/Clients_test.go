@@ -0,0 +1,99 @@
+package clients
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Group(t *testing.T) {
+	leases, err := LoadLeases(writeLeases(t, leaseFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMatcher([]Group{
+		{Name: "servers", Clients: []string{"192.168.1.10", "fd00::10"}},
+		{Name: "kids", Clients: []string{"192.168.1.0/24", "AA-BB-CC-DD-EE-FF"}},
+		{Name: "guests", Clients: []string{"192.168.0.0/16", "fd00::/64"}},
+	}, leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"192.168.1.10":    "servers", // on every group, the first one wins
+		"fd00::10":        "servers",
+		"192.168.1.77":    "kids",
+		"192.168.2.1":     "guests",
+		"fd00::1234":      "guests",
+		"10.0.0.1":        "",
+		"fd01::1":         "",
+		"::ffff:10.0.0.1": "",
+	}
+	for ip, want := range tests {
+		if got := m.Group(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected group %q, got %q", ip, want, got)
+		}
+	}
+
+	// The MAC leasing an address decides before a later group's networks
+	m, err = NewMatcher([]Group{
+		{Name: "tablet", Clients: []string{"aa:bb:cc:dd:ee:ff"}},
+		{Name: "lan", Clients: []string{"192.168.1.0/24"}},
+	}, leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Group(net.ParseIP("192.168.1.64")); got != "tablet" {
+		t.Errorf("Expected the leased MAC to match, got %q", got)
+	}
+	if got := m.Group(net.ParseIP("192.168.1.10")); got != "lan" {
+		t.Errorf("Expected another MAC to fall through to the network, got %q", got)
+	}
+
+	var none *Matcher
+	if none.Group(net.ParseIP("192.168.1.10")) != "" || m.Group(nil) != "" {
+		t.Error("Expected no group without a matcher or an address")
+	}
+}
+
+func Test_NewMatcherErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []Group
+		err    string
+	}{
+		{name: "MAC without a lease file", groups: []Group{{Name: "kids", Clients: []string{"aa:bb:cc:dd:ee:ff"}}}, err: "need a lease file"},
+		{name: "not a client", groups: []Group{{Name: "kids", Clients: []string{"tablet"}}}, err: `"tablet" is not an address, network or MAC`},
+		{name: "broken network", groups: []Group{{Name: "kids", Clients: []string{"192.168.1.0/33"}}}, err: "group kids"},
+	}
+	for _, tt := range tests {
+		_, err := NewMatcher(tt.groups, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error with %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func Test_Networks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"192.0.2.53", "2001:db8::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"192.0.2.53":        true,
+		"::ffff:192.0.2.53": true,
+		"192.0.2.54":        false,
+		"2001:db8::1":       true,
+		"2001:db8:1::1":     false,
+	}
+	for ip, want := range tests {
+		if got := networks.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected %v, got %v", ip, want, got)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"192.0.2.53", "relay"}); err == nil {
+		t.Error("Expected an error for an entry that is not an address")
+	}
+}
@@ -0,0 +1,88 @@
+package clients
+
+import (
+	"bufio"
+	"context"
+	"dnsthingymagik/server/filewatch"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pollInterval = 5 * time.Second // how often the lease file is checked for changes
+
+// Leases maps client addresses to MAC addresses from a dnsmasq lease file, lines of
+// the form: expiry mac address hostname client-id
+type Leases struct {
+	path    string
+	watcher *filewatch.Watcher
+
+	mu   sync.RWMutex
+	macs map[string]string
+}
+
+// LoadLeases reads a dnsmasq lease file.
+func LoadLeases(path string) (*Leases, error) {
+	l := &Leases{path: path, watcher: filewatch.New(path)}
+	err := l.reload()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Leases) reload() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	macs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// DHCPv6 leases have a DUID instead of a MAC and are skipped
+		mac, err := net.ParseMAC(fields[1])
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			continue
+		}
+		macs[ip.String()] = mac.String()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.macs = macs
+	return nil
+}
+
+// MAC of the client leasing ip, "" when unknown.
+func (l *Leases) MAC(ip net.IP) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.macs[ip.String()]
+}
+
+// Watch rereads the lease file whenever it changes, until ctx is done.
+func (l *Leases) Watch(ctx context.Context) {
+	if l == nil {
+		return
+	}
+
+	l.watcher.Run(ctx, pollInterval, func() {
+		err := l.reload()
+		if err != nil {
+			log.Printf("Lease file reload error, keeping the old leases: %v", err)
+		}
+	})
+}
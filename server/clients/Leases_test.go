@@ -0,0 +1,66 @@
+package clients
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dnsmasq writes the DHCPv6 leases after a "duid" line, with an IAID where the MAC would be
+const leaseFixture = `1700000000 aa:bb:cc:dd:ee:ff 192.168.1.64 kids-tablet 01:aa:bb:cc:dd:ee:ff
+1700000000 11:22:33:44:55:66 192.168.1.10 nas *
+0 AA:BB:CC:00:11:22 192.168.1.11 * *
+broken line
+duid 00:01:00:01:2a:3b:4c:5d:aa:bb:cc:dd:ee:ff
+1700000000 1234567890 fd00::64 kids-tablet 00:01:00:01:2a:3b:4c:5d:aa:bb:cc:dd:ee:ff
+1700000000 aa:bb:cc:dd:ee:ff not-an-address x *
+`
+
+func writeLeases(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_LoadLeases(t *testing.T) {
+	path := writeLeases(t, leaseFixture)
+	leases, err := LoadLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"192.168.1.64":  "aa:bb:cc:dd:ee:ff",
+		"192.168.1.10":  "11:22:33:44:55:66",
+		"192.168.1.11":  "aa:bb:cc:00:11:22", // MACs are normalized
+		"fd00::64":      "",                  // DHCPv6, no MAC
+		"192.168.1.200": "",
+	}
+	for ip, want := range tests {
+		if got := leases.MAC(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected %q, got %q", ip, want, got)
+		}
+	}
+	if len(leases.macs) != 3 {
+		t.Errorf("Expected the three DHCPv4 leases, got %v", leases.macs)
+	}
+
+	// A reload replaces the leases
+	if err := os.WriteFile(path, []byte("1700000000 aa:bb:cc:dd:ee:ff 192.168.1.65 kids-tablet *\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := leases.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if leases.MAC(net.ParseIP("192.168.1.64")) != "" || leases.MAC(net.ParseIP("192.168.1.65")) != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Expected the new lease only, got %v", leases.macs)
+	}
+
+	if _, err := LoadLeases(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing lease file")
+	}
+}
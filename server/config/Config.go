@@ -0,0 +1,313 @@
+package config
+
+import (
+	"cmp"
+	"dnsthingymagik/server/edns"
+	"dnsthingymagik/server/schedule"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+const (
+	ModeRecursive = "recursive" // iterate from the root servers
+	ModeForward   = "forward"   // send every question to the upstream resolvers
+
+	DefaultHostsTTL = 60 // of answers from the hosts files
+)
+
+type Config struct {
+	// UDP payload size advertised to clients in EDNS(0) replies
+	EDNSBufferSize uint16 `json:"edns_buffer_size"`
+	// named.root style file replacing the built-in root servers
+	RootHintsFile string `json:"root_hints_file"`
+
+	Mode string `json:"mode"`
+	// Resolvers used in forward mode, "ip" or "ip:port"
+	Upstreams []string `json:"upstreams"`
+	// sequential, round-robin, fastest or parallel
+	UpstreamStrategy string `json:"upstream_strategy"`
+	// How long to wait for a single upstream before trying the next one
+	UpstreamTimeoutMs int `json:"upstream_timeout_ms"`
+
+	// Zones sent to their own servers in either mode, the longest matching zone wins
+	ConditionalForwarders []ConditionalForwarder `json:"conditional_forwarders"`
+
+	// Records answered by this server itself with the AA flag, YAML (.yaml, .yml), TOML (.toml) or JSON
+	LocalRecordsFile string `json:"local_records_file"`
+	// /etc/hosts style files for A, AAAA and PTR answers, reread when they change
+	HostsFiles []string `json:"hosts_files"`
+	HostsTTL   uint32   `json:"hosts_ttl"`
+
+	// Names on these lists, and everything below them, are answered without resolving
+	Blocklists []Blocklist `json:"blocklists"`
+	// Names on these lists are resolved even when a blocklist has them
+	Allowlists []Allowlist `json:"allowlists"`
+	// Weekly time windows lists can be limited to
+	Schedules []Schedule `json:"schedules"`
+
+	// Clients with their own lists and upstreams, the first group listing a client wins.
+	// Clients in no group get every list and the server's own resolution.
+	Groups []Group `json:"groups"`
+	// Identify clients by the EDNS Client Subnet they send, for queries relayed by another resolver
+	UseClientSubnet bool `json:"use_client_subnet"`
+	// Addresses and networks of the relays whose Client Subnet is believed, nobody else's is
+	ClientSubnetFrom []string `json:"client_subnet_from"`
+	// dnsmasq lease file mapping addresses to MACs, for groups listing MAC addresses
+	LeasesFile string `json:"leases_file"`
+
+	// Rewrite search engines and video sites to their safe search endpoints for clients in no group
+	SafeSearch bool `json:"safe_search"`
+	// "domain target" lines adding to and overriding the built-in safe search endpoints
+	SafeSearchFile string `json:"safe_search_file"`
+
+	// Response policy zones applied to every client, the first zone with a matching trigger wins
+	RPZ []RPZZone `json:"rpz"`
+}
+
+// RPZZone is a response policy zone in a master file, names in it relative to Zone.
+type RPZZone struct {
+	Zone string `json:"zone"`
+	Path string `json:"path"`
+}
+
+type ConditionalForwarder struct {
+	Zone    string   `json:"zone"`
+	Servers []string `json:"servers"`
+	// Ask the servers not to validate DNSSEC (CD bit), for zones unreachable from the public root
+	SkipDNSSEC bool `json:"skip_dnssec"`
+}
+
+// Blocklist is a hosts file, plain domain list or AdBlock style ||domain^ list,
+// with regex and glob rules mixed in. Rules are written inline, in the file or both.
+type Blocklist struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Rules []string `json:"rules"`
+	// Download the list from here into path, which is used when the URL is unreachable
+	URL string `json:"url"`
+	// How often the URL is checked for changes, daily when zero
+	RefreshMinutes int `json:"refresh_minutes"`
+	// nxdomain (default), nodata, refused, null or sinkhole
+	Response string   `json:"response"`
+	Sinkhole []string `json:"sinkhole"`
+	// TTL of blocked answers, negative ones included
+	TTL uint32 `json:"ttl"`
+	// Name of the schedule during which the list applies, always when empty
+	Schedule string `json:"schedule"`
+}
+
+// Allowlist has the same formats as a blocklist, every rule on it allows.
+type Allowlist struct {
+	Name           string   `json:"name"`
+	Path           string   `json:"path"`
+	Rules          []string `json:"rules"`
+	URL            string   `json:"url"`
+	RefreshMinutes int      `json:"refresh_minutes"`
+	Schedule       string   `json:"schedule"`
+}
+
+// Schedule is a set of weekly time windows, lists attached to it only apply inside them.
+type Schedule struct {
+	Name string `json:"name"`
+	// IANA timezone like "Europe/Ljubljana", the server's local time when empty
+	Timezone string   `json:"timezone"`
+	Periods  []Period `json:"periods"`
+}
+
+// Parse turns the schedule into its matcher.
+func (s Schedule) Parse() (*schedule.Schedule, error) {
+	var periods []schedule.Period
+	for _, period := range s.Periods {
+		periods = append(periods, schedule.Period{Days: period.Days, From: period.From, To: period.To})
+	}
+	return schedule.New(s.Name, s.Timezone, periods)
+}
+
+type Period struct {
+	// mon..sun, weekdays or weekend, every day when empty
+	Days []string `json:"days"`
+	// HH:MM, a To before From ends the next day
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Group struct {
+	Name string `json:"name"`
+	// Addresses, networks in CIDR form or MAC addresses
+	Clients []string `json:"clients"`
+	// Names of the lists applied to the group, a group without lists filters nothing
+	Blocklists []string `json:"blocklists"`
+	Allowlists []string `json:"allowlists"`
+	// Forward the group's questions to these resolvers instead of the server's own
+	Upstreams        []string `json:"upstreams"`
+	UpstreamStrategy string   `json:"upstream_strategy"`
+	SafeSearch       bool     `json:"safe_search"`
+}
+
+// Default returns the configuration used when no config file is given.
+func Default() *Config {
+	return &Config{
+		EDNSBufferSize:   edns.DefaultUDPSize,
+		Mode:             ModeRecursive,
+		UpstreamStrategy: "sequential",
+		HostsTTL:         DefaultHostsTTL,
+	}
+}
+
+// Load reads a JSON config file, fields missing from the file keep their defaults.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.EDNSBufferSize < edns.MinUDPSize {
+		cfg.EDNSBufferSize = edns.MinUDPSize
+	}
+
+	switch cfg.Mode {
+	case ModeRecursive:
+	case ModeForward:
+		if len(cfg.Upstreams) == 0 {
+			return nil, fmt.Errorf("%s: forward mode needs upstreams", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown mode %q", path, cfg.Mode)
+	}
+
+	for _, rule := range cfg.ConditionalForwarders {
+		if rule.Zone == "" || len(rule.Servers) == 0 {
+			return nil, fmt.Errorf("%s: conditional forwarder needs a zone and servers", path)
+		}
+	}
+
+	for _, list := range cfg.Blocklists {
+		if list.Path == "" && len(list.Rules) == 0 {
+			return nil, fmt.Errorf("%s: blocklist %q needs a path or rules", path, list.Name)
+		}
+		err = checkSource(list.URL, list.Path, list.RefreshMinutes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: blocklist %q: %w", path, list.Name, err)
+		}
+	}
+
+	for _, list := range cfg.Allowlists {
+		if list.Path == "" && len(list.Rules) == 0 {
+			return nil, fmt.Errorf("%s: allowlist %q needs a path or rules", path, list.Name)
+		}
+		err = checkSource(list.URL, list.Path, list.RefreshMinutes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: allowlist %q: %w", path, list.Name, err)
+		}
+	}
+
+	for _, zone := range cfg.RPZ {
+		if zone.Zone == "" || zone.Path == "" {
+			return nil, fmt.Errorf("%s: rpz zone needs a zone and a path", path)
+		}
+	}
+
+	if cfg.UseClientSubnet && len(cfg.ClientSubnetFrom) == 0 {
+		return nil, fmt.Errorf("%s: use_client_subnet needs the trusted relays in client_subnet_from", path)
+	}
+
+	err = checkSchedules(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = checkGroups(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// A downloaded list needs a path to keep its copy in.
+func checkSource(rawURL, path string, refreshMinutes int) error {
+	if rawURL == "" {
+		return nil
+	}
+	if path == "" {
+		return fmt.Errorf("url needs a path for the downloaded copy")
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("url %q is not http or https", rawURL)
+	}
+	if refreshMinutes < 0 {
+		return fmt.Errorf("negative refresh_minutes")
+	}
+	return nil
+}
+
+// Schedules must parse and lists may only name schedules that exist.
+func checkSchedules(cfg *Config) error {
+	names := make(map[string]bool)
+	for _, sched := range cfg.Schedules {
+		_, err := sched.Parse()
+		if err != nil {
+			return err
+		}
+		if sched.Name == "" || names[sched.Name] {
+			return fmt.Errorf("schedules need unique names, %q is not", sched.Name)
+		}
+		names[sched.Name] = true
+	}
+
+	for _, list := range cfg.Blocklists {
+		if list.Schedule != "" && !names[list.Schedule] {
+			return fmt.Errorf("blocklist %s: no schedule %q", cmp.Or(list.Name, list.Path), list.Schedule)
+		}
+	}
+	for _, list := range cfg.Allowlists {
+		if list.Schedule != "" && !names[list.Schedule] {
+			return fmt.Errorf("allowlist %s: no schedule %q", cmp.Or(list.Name, list.Path), list.Schedule)
+		}
+	}
+	return nil
+}
+
+// Groups need a unique name and may only name lists that exist, a list without a
+// name goes by its path.
+func checkGroups(cfg *Config) error {
+	blocklists := make(map[string]bool)
+	for _, list := range cfg.Blocklists {
+		blocklists[cmp.Or(list.Name, list.Path)] = true
+	}
+	allowlists := make(map[string]bool)
+	for _, list := range cfg.Allowlists {
+		allowlists[cmp.Or(list.Name, list.Path)] = true
+	}
+
+	names := make(map[string]bool)
+	for _, group := range cfg.Groups {
+		if group.Name == "" || names[group.Name] {
+			return fmt.Errorf("groups need unique names, %q is not", group.Name)
+		}
+		names[group.Name] = true
+
+		for _, name := range group.Blocklists {
+			if !blocklists[name] {
+				return fmt.Errorf("group %s: no blocklist %q", group.Name, name)
+			}
+		}
+		for _, name := range group.Allowlists {
+			if !allowlists[name] {
+				return fmt.Errorf("group %s: no allowlist %q", group.Name, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package edns
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const OptionCodeECS = 8 // Client Subnet, RFC 7871
+
+// ClientSubnet returns the network from a Client Subnet option, nil when there is
+// none or it is malformed.
+func (o *OPT) ClientSubnet() *net.IPNet {
+	if o == nil {
+		return nil
+	}
+
+	for _, option := range o.Options {
+		if option.Code != OptionCodeECS || len(option.Data) < 4 {
+			continue
+		}
+
+		family := binary.BigEndian.Uint16(option.Data)
+		prefix := int(option.Data[2])
+		addr := option.Data[4:]
+
+		var ip net.IP
+		var bits int
+		switch family {
+		case 1:
+			ip, bits = make(net.IP, net.IPv4len), 32
+		case 2:
+			ip, bits = make(net.IP, net.IPv6len), 128
+		default:
+			return nil
+		}
+		// Only the bytes covering the prefix are sent (RFC 7871 section 6)
+		if prefix > bits || len(addr) != (prefix+7)/8 {
+			return nil
+		}
+		copy(ip, addr)
+
+		mask := net.CIDRMask(prefix, bits)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package edns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+)
+
+func ecs(family uint16, prefix byte, addr ...byte) dnsmessage.Option {
+	return dnsmessage.Option{Code: OptionCodeECS, Data: append([]byte{byte(family >> 8), byte(family), prefix, 0}, addr...)}
+}
+
+func Test_ClientSubnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []dnsmessage.Option
+		want    string // "" for nil
+	}{
+		{name: "none", want: ""},
+		{name: "IPv4 /24", options: []dnsmessage.Option{ecs(1, 24, 192, 0, 2)}, want: "192.0.2.0/24"},
+		{name: "IPv4 /32", options: []dnsmessage.Option{ecs(1, 32, 192, 0, 2, 1)}, want: "192.0.2.1/32"},
+		{name: "bits past the prefix are masked", options: []dnsmessage.Option{ecs(1, 20, 192, 0, 255)}, want: "192.0.240.0/20"},
+		{name: "IPv4 /0", options: []dnsmessage.Option{ecs(1, 0)}, want: "0.0.0.0/0"},
+		{name: "IPv6 /56", options: []dnsmessage.Option{ecs(2, 56, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0x12)}, want: "2001:db8:0:1200::/56"},
+		{name: "after other options", options: []dnsmessage.Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, ecs(1, 8, 10)}, want: "10.0.0.0/8"},
+		{name: "too many address bytes", options: []dnsmessage.Option{ecs(1, 24, 192, 0, 2, 1)}, want: ""},
+		{name: "too few address bytes", options: []dnsmessage.Option{ecs(1, 24, 192, 0)}, want: ""},
+		{name: "prefix too long", options: []dnsmessage.Option{ecs(1, 33, 192, 0, 2, 1, 0)}, want: ""},
+		{name: "unknown family", options: []dnsmessage.Option{ecs(3, 8, 10)}, want: ""},
+		{name: "truncated option", options: []dnsmessage.Option{{Code: OptionCodeECS, Data: []byte{0, 1}}}, want: ""},
+	}
+
+	for _, tt := range tests {
+		got := (&OPT{Options: tt.options}).ClientSubnet()
+		switch {
+		case got == nil && tt.want != "":
+			t.Errorf("%s: expected %s, got nil", tt.name, tt.want)
+		case got != nil && got.String() != tt.want:
+			t.Errorf("%s: expected %q, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	var opt *OPT
+	if opt.ClientSubnet() != nil {
+		t.Error("Expected nil for a message without OPT")
+	}
+}
@@ -0,0 +1,22 @@
+package edns
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Extended DNS Errors, RFC 8914
+const (
+	OptionCodeEDE = 15
+
+	EDEBlocked = 15 // blocked by the operator of this server
+)
+
+// ExtendedError builds an EDE option, text is optional and meant for humans.
+func ExtendedError(infoCode uint16, text string) dnsmessage.Option {
+	data := binary.BigEndian.AppendUint16(nil, infoCode)
+	return dnsmessage.Option{
+		Code: OptionCodeEDE,
+		Data: append(data, text...),
+	}
+}
@@ -0,0 +1,76 @@
+package edns
+
+import (
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	Version        = 0    // highest EDNS version this server implements
+	MinUDPSize     = 512  // RFC 1035 limit, also used for smaller advertised sizes (RFC 6891 section 6.2.5)
+	DefaultUDPSize = 1232 // DNS flag day 2020 recommendation, avoids IP fragmentation
+
+	RCodeBadVersion dnsmessage.RCode = 16 // BADVERS, RFC 6891 section 9
+
+	doBit = 0x8000
+)
+
+var ErrMultipleOPT = errors.New("message contains more than one OPT record")
+
+// OPT is the decoded EDNS(0) pseudo-record of a message.
+type OPT struct {
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	DNSSECOK      bool
+	Options       []dnsmessage.Option // unknown options are kept but otherwise ignored
+}
+
+// Parse returns the OPT record from the additional section, nil if the message carries none.
+func Parse(msg dnsmessage.Message) (*OPT, error) {
+	var opt *OPT
+	for _, additional := range msg.Additionals {
+		if additional.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+
+		if opt != nil {
+			return nil, ErrMultipleOPT
+		}
+
+		opt = &OPT{
+			UDPSize:       uint16(additional.Header.Class),
+			ExtendedRCode: uint8(additional.Header.TTL >> 24),
+			Version:       uint8(additional.Header.TTL >> 16),
+			DNSSECOK:      additional.Header.TTL&doBit != 0, // DNSSECAllowed also checks the version, BADVERS replies still echo DO
+		}
+		if body, ok := additional.Body.(*dnsmessage.OPTResource); ok {
+			opt.Options = body.Options
+		}
+	}
+
+	return opt, nil
+}
+
+// MaxPayload returns the largest UDP reply the sender of this OPT accepts.
+func (o *OPT) MaxPayload() int {
+	if o == nil || o.UDPSize < MinUDPSize {
+		return MinUDPSize
+	}
+	return int(o.UDPSize)
+}
+
+// NewOPT builds an OPT resource advertising udpSize, rcode carries the full extended RCODE.
+func NewOPT(udpSize uint16, rcode dnsmessage.RCode, dnssecOK bool, options ...dnsmessage.Option) dnsmessage.Resource {
+	if udpSize < MinUDPSize {
+		udpSize = MinUDPSize
+	}
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(int(udpSize), rcode, dnssecOK)
+
+	return dnsmessage.Resource{
+		Header: header,
+		Body:   &dnsmessage.OPTResource{Options: options},
+	}
+}
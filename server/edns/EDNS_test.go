@@ -0,0 +1,123 @@
+package edns
+
+import (
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+)
+
+func optResource(udpSize uint16, extendedRCode, version uint8, do bool, options ...dnsmessage.Option) dnsmessage.Resource {
+	ttl := uint32(extendedRCode)<<24 | uint32(version)<<16
+	if do {
+		ttl |= doBit
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeOPT,
+			Class: dnsmessage.Class(udpSize),
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.OPTResource{Options: options},
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	cookie := dnsmessage.Option{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	a := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+	}
+
+	tests := []struct {
+		name        string
+		additionals []dnsmessage.Resource
+		want        *OPT
+		err         error
+	}{
+		{name: "no OPT", additionals: []dnsmessage.Resource{a}, want: nil},
+		{
+			name:        "plain",
+			additionals: []dnsmessage.Resource{optResource(4096, 0, 0, false)},
+			want:        &OPT{UDPSize: 4096},
+		},
+		{
+			name:        "DO bit, version and extended RCODE",
+			additionals: []dnsmessage.Resource{a, optResource(1232, 1, 1, true, cookie)},
+			want:        &OPT{UDPSize: 1232, ExtendedRCode: 1, Version: 1, DNSSECOK: true, Options: []dnsmessage.Option{cookie}},
+		},
+		{
+			name:        "two OPT records",
+			additionals: []dnsmessage.Resource{optResource(4096, 0, 0, false), optResource(512, 0, 0, false)},
+			err:         ErrMultipleOPT,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(dnsmessage.Message{Additionals: tt.additionals})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("Expected %+v, got %+v", tt.want, got)
+			}
+			if got == nil {
+				return
+			}
+			if got.UDPSize != tt.want.UDPSize || got.ExtendedRCode != tt.want.ExtendedRCode ||
+				got.Version != tt.want.Version || got.DNSSECOK != tt.want.DNSSECOK || len(got.Options) != len(tt.want.Options) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_MaxPayload(t *testing.T) {
+	tests := []struct {
+		opt  *OPT
+		want int
+	}{
+		{opt: nil, want: MinUDPSize},
+		{opt: &OPT{UDPSize: 100}, want: MinUDPSize},
+		{opt: &OPT{UDPSize: 512}, want: 512},
+		{opt: &OPT{UDPSize: 4096}, want: 4096},
+	}
+	for _, tt := range tests {
+		if got := tt.opt.MaxPayload(); got != tt.want {
+			t.Errorf("Expected max payload %d for %+v, got %d", tt.want, tt.opt, got)
+		}
+	}
+}
+
+func Test_NewOPTRoundTrip(t *testing.T) {
+	ede := ExtendedError(EDEBlocked, "blocked")
+	resource := NewOPT(100, RCodeBadVersion, true, ede)
+
+	// Packed and parsed again the way a client would see it
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Additionals: []dnsmessage.Resource{resource}}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	var unpacked dnsmessage.Message
+	err = unpacked.Unpack(packed)
+	if err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+
+	opt, err := Parse(unpacked)
+	if err != nil || opt == nil {
+		t.Fatalf("Expected an OPT record, got %v %v", opt, err)
+	}
+	if opt.UDPSize != MinUDPSize {
+		t.Errorf("Expected the advertised size to be raised to %d, got %d", MinUDPSize, opt.UDPSize)
+	}
+	// BADVERS is 16, its upper 8 bits travel in the OPT record
+	if opt.ExtendedRCode != 1 || !opt.DNSSECOK {
+		t.Errorf("Expected extended RCODE 1 and DO set, got %d and %v", opt.ExtendedRCode, opt.DNSSECOK)
+	}
+	if len(opt.Options) != 1 || opt.Options[0].Code != OptionCodeEDE || string(opt.Options[0].Data[2:]) != "blocked" {
+		t.Errorf("Expected the EDE option to survive, got %+v", opt.Options)
+	}
+}
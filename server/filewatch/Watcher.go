@@ -0,0 +1,77 @@
+package filewatch
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// What a file looked like when it was last looked at, a change means it is read again
+type stamp struct {
+	modTime time.Time
+	size    int64
+	missing bool
+}
+
+func stat(path string) stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{missing: true}
+	}
+	return stamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// Watcher notices changes to files by polling their modification time and size.
+type Watcher struct {
+	paths  []string
+	stamps map[string]stamp
+}
+
+// New stamps the files as they are now. Create it before reading them, so a change made
+// while they are read is still noticed.
+func New(paths ...string) *Watcher {
+	w := &Watcher{paths: paths, stamps: make(map[string]stamp)}
+	for _, path := range paths {
+		w.stamps[path] = stat(path)
+	}
+	return w
+}
+
+// Changed reports whether any file changed since the last call. A file that went missing
+// is logged once and is no change, the caller keeps what it read before until it is back.
+func (w *Watcher) Changed() bool {
+	changed := false
+	for _, path := range w.paths {
+		now := stat(path)
+		if now == w.stamps[path] {
+			continue
+		}
+		w.stamps[path] = now
+
+		if now.missing {
+			log.Printf("%s is missing, keeping what was read before", path)
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// Run calls reload whenever a file changed, checking every interval until ctx is done.
+// A reload that fails is not retried until the next change.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, reload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if w.Changed() {
+			reload()
+		}
+	}
+}
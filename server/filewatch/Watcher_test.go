@@ -0,0 +1,75 @@
+package filewatch
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Changed(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := New(path)
+
+	if w.Changed() {
+		t.Error("Expected no change for an untouched file")
+	}
+
+	// Same size, only the modification time moves
+	if err := os.WriteFile(path, []byte("two"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Changed() {
+		t.Error("Expected a new modification time to be a change")
+	}
+	if w.Changed() {
+		t.Error("Expected a change to be reported once")
+	}
+
+	// A missing file is logged once and is no change
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if w.Changed() || w.Changed() {
+		t.Error("Expected a missing file not to be a change")
+	}
+	if n := strings.Count(logged.String(), "is missing"); n != 1 {
+		t.Errorf("Expected the missing file to be logged once, got %d times", n)
+	}
+
+	// Coming back is
+	if err := os.WriteFile(path, []byte("three"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Changed() {
+		t.Error("Expected a file coming back to be a change")
+	}
+}
+
+func Test_NewMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "later")
+	w := New(path)
+	if w.Changed() {
+		t.Error("Expected a file missing from the start not to be a change")
+	}
+
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Changed() {
+		t.Error("Expected a file appearing to be a change")
+	}
+}
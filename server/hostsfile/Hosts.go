@@ -0,0 +1,199 @@
+package hostsfile
+
+import (
+	"bufio"
+	"context"
+	"dnsthingymagik/server/filewatch"
+	"dnsthingymagik/server/resolver/entities"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pollInterval = 2 * time.Second // how often the files are checked for changes
+
+// Hosts answers A, AAAA and PTR questions from /etc/hosts style files.
+type Hosts struct {
+	paths   []string
+	ttl     uint32
+	watcher *filewatch.Watcher
+
+	mu    sync.RWMutex
+	addrs map[string][]net.IP // host name to addresses, in file order
+	names map[string]string   // reverse name to the canonical host name of the address
+}
+
+// Load reads the hosts files, answers get the given TTL.
+func Load(paths []string, ttl uint32) (*Hosts, error) {
+	h := &Hosts{paths: paths, ttl: ttl, watcher: filewatch.New(paths...)}
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Read every file again and swap in the new data; on error the old data stays.
+func (h *Hosts) reload() error {
+	addrs := make(map[string][]net.IP)
+	names := make(map[string]string)
+
+	for _, path := range h.paths {
+		err := parse(path, addrs, names)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs, h.names = addrs, names
+	return nil
+}
+
+// Parse lines of the form: address name [aliases...] [# comment]
+func parse(path string, addrs map[string][]net.IP, names map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Zone of a link-local address, "fe80::1%eth0", means nothing in DNS
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("%s:%d: invalid address %q", path, lineNo, fields[0])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		for _, host := range fields[1:] {
+			_, err := dnsmessage.NewName(entities.FQDN(host))
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			key := strings.ToLower(entities.FQDN(host))
+			if !contains(addrs[key], ip) {
+				addrs[key] = append(addrs[key], ip)
+			}
+		}
+
+		// The first name on a line is the canonical one, the first line for an address wins
+		reverse := ReverseName(ip)
+		if _, ok := names[reverse]; !ok {
+			names[reverse] = entities.FQDN(fields[1])
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Lookup answers a question from the hosts files and reports whether the name is in them.
+// Names in the files without an address of the asked type get NODATA.
+func (h *Hosts) Lookup(name dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, bool) {
+	if h == nil {
+		return entities.Result{}, false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	key := strings.ToLower(name.String())
+	result := entities.Result{RCode: dnsmessage.RCodeSuccess, Authoritative: true}
+	header := dnsmessage.ResourceHeader{Name: name, Type: rtype, Class: dnsmessage.ClassINET, TTL: h.ttl}
+
+	if host, ok := h.names[key]; ok {
+		if rtype == dnsmessage.TypePTR {
+			result.Answers = append(result.Answers, entities.NewRecord(dnsmessage.Resource{
+				Header: header,
+				Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(host)},
+			}))
+		}
+		return result, true
+	}
+
+	addrs, ok := h.addrs[key]
+	if !ok {
+		return entities.Result{}, false
+	}
+	for _, ip := range addrs {
+		var body dnsmessage.ResourceBody
+		switch {
+		case rtype == dnsmessage.TypeA && len(ip) == net.IPv4len:
+			body = &dnsmessage.AResource{A: [4]byte(ip)}
+		case rtype == dnsmessage.TypeAAAA && len(ip) == net.IPv6len:
+			body = &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}
+		default:
+			continue
+		}
+		result.Answers = append(result.Answers, entities.NewRecord(dnsmessage.Resource{Header: header, Body: body}))
+	}
+	return result, true
+}
+
+// Watch rereads the files whenever one of them changes, until ctx is done.
+func (h *Hosts) Watch(ctx context.Context) {
+	if h == nil {
+		return
+	}
+
+	h.watcher.Run(ctx, pollInterval, func() {
+		err := h.reload()
+		if err != nil {
+			log.Printf("Hosts file reload error, keeping the old data: %v", err)
+			return
+		}
+		log.Printf("Reloaded hosts files %v", h.paths)
+	})
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func ReverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+
+	const hexDigits = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0xF])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+func contains(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
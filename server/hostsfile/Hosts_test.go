@@ -0,0 +1,138 @@
+package hostsfile
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const hosts = `# comment line
+127.0.0.1	localhost
+192.168.1.10	nas.home nas   # trailing comment
+192.168.1.11	nas.home
+fd00::10	nas.home
+192.168.1.10	alias.home
+fe80::1%eth0	router.home
+
+192.168.1.20	Printer.Home.
+`
+
+func loadHosts(t *testing.T, content string) *Hosts {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := Load([]string{path}, 60)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	return h
+}
+
+// RDATA of the answers as text, nil when the name is not in the files
+func lookup(h *Hosts, name string, rtype dnsmessage.Type) []string {
+	result, found := h.Lookup(dnsmessage.MustNewName(name), rtype)
+	if !found {
+		return nil
+	}
+	got := []string{}
+	for _, record := range result.Answers {
+		if ptr, ok := record.Body.(*dnsmessage.PTRResource); ok {
+			got = append(got, ptr.PTR.String())
+		} else {
+			got = append(got, record.IP().String())
+		}
+	}
+	return got
+}
+
+func Test_Lookup(t *testing.T) {
+	h := loadHosts(t, hosts)
+
+	tests := []struct {
+		name  string
+		rtype dnsmessage.Type
+		want  []string // nil when not found, empty for NODATA
+	}{
+		{"nas.home.", dnsmessage.TypeA, []string{"192.168.1.10", "192.168.1.11"}},
+		{"NAS.home.", dnsmessage.TypeA, []string{"192.168.1.10", "192.168.1.11"}},
+		{"nas.", dnsmessage.TypeA, []string{"192.168.1.10"}},
+		{"nas.home.", dnsmessage.TypeAAAA, []string{"fd00::10"}},
+		{"localhost.", dnsmessage.TypeAAAA, []string{}},
+		{"nas.home.", dnsmessage.TypeMX, []string{}},
+		{"router.home.", dnsmessage.TypeAAAA, []string{"fe80::1"}},
+		{"printer.home.", dnsmessage.TypeA, []string{"192.168.1.20"}},
+		{"example.com.", dnsmessage.TypeA, nil},
+		// The first name of the first line for an address is canonical
+		{"10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, []string{"nas.home."}},
+		{"20.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, []string{"Printer.Home."}},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dnsmessage.TypePTR, []string{"nas.home."}},
+		{"10.1.168.192.in-addr.arpa.", dnsmessage.TypeA, []string{}},
+		{"99.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, nil},
+	}
+
+	for _, tt := range tests {
+		got := lookup(h, tt.name, tt.rtype)
+		if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+			t.Errorf("%s %s: expected %q, got %q", tt.name, tt.rtype, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %s: expected %q, got %q", tt.name, tt.rtype, tt.want, got)
+				break
+			}
+		}
+	}
+
+	result, _ := h.Lookup(dnsmessage.MustNewName("nas.home."), dnsmessage.TypeA)
+	if !result.Authoritative || result.Answers[0].TTL != 60 {
+		t.Errorf("Expected authoritative answers with the configured TTL, got AA=%v TTL=%d", result.Authoritative, result.Answers[0].TTL)
+	}
+}
+
+func Test_LoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{"not-an-ip host\n", "192.0.2.1 " + strings.Repeat("a", 300) + "\n"} {
+		path := filepath.Join(dir, "hosts")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load([]string{path}, 60); err == nil {
+			t.Errorf("Expected %q to fail", content)
+		}
+	}
+	if _, err := Load([]string{filepath.Join(dir, "missing")}, 60); err == nil {
+		t.Error("Expected a missing file to fail")
+	}
+}
+
+func Test_ReloadKeepsOldData(t *testing.T) {
+	h := loadHosts(t, "192.0.2.1 a.home\n")
+	if err := os.WriteFile(h.paths[0], []byte("bogus a.home\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.reload(); err == nil {
+		t.Fatal("Expected the broken file to fail")
+	}
+	if got := lookup(h, "a.home.", dnsmessage.TypeA); len(got) != 1 || got[0] != "192.0.2.1" {
+		t.Errorf("Expected the old data to stay, got %q", got)
+	}
+}
+
+func Test_ReverseName(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":          "1.2.0.192.in-addr.arpa.",
+		"::ffff:10.0.0.1":    "1.0.0.10.in-addr.arpa.",
+		"2001:db8::567:89ab": "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+	for in, want := range tests {
+		if got := ReverseName(net.ParseIP(in)); got != want {
+			t.Errorf("ReverseName(%s): expected %s, got %s", in, want, got)
+		}
+	}
+}
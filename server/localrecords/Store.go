@@ -0,0 +1,216 @@
+package localrecords
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v3"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultTTL = 300
+
+// File is the layout of a local records file, in JSON, YAML or TOML.
+type File struct {
+	// TTL for entries without their own
+	TTL     uint32  `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Records []Entry `json:"records" yaml:"records" toml:"records"`
+}
+
+// Entry is one RRset, "*.example.lan" owners match every name below example.lan.
+type Entry struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	Type string `json:"type" yaml:"type" toml:"type"`
+	TTL  uint32 `json:"ttl" yaml:"ttl" toml:"ttl"`
+	// RDATA in presentation format, one record per value
+	Values []string `json:"values" yaml:"values" toml:"values"`
+}
+
+// Store answers questions for names configured locally, before any recursion.
+type Store struct {
+	names     map[string]map[dnsmessage.Type][]entities.Record
+	wildcards map[string]map[dnsmessage.Type][]entities.Record // keyed by the name below the "*"
+	parents   map[string]bool                                  // names with configured names below them
+}
+
+func NewStore() *Store {
+	return &Store{
+		names:     make(map[string]map[dnsmessage.Type][]entities.Record),
+		wildcards: make(map[string]map[dnsmessage.Type][]entities.Record),
+		parents:   make(map[string]bool),
+	}
+}
+
+// Load reads a local records file, the extension picks the format: .yaml or .yml for
+// YAML, .toml for TOML and JSON for anything else.
+func Load(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := File{TTL: DefaultTTL}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	store := NewStore()
+	for _, entry := range file.Records {
+		if entry.TTL == 0 {
+			entry.TTL = file.TTL
+		}
+		err = store.Add(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return store, nil
+}
+
+// Add parses an entry and adds its records to the store.
+func (s *Store) Add(entry Entry) error {
+	rtype, err := entities.ParseType(entry.Type)
+	if err != nil {
+		return err
+	}
+	if len(entry.Values) == 0 {
+		return fmt.Errorf("%s %s has no values", entry.Name, entry.Type)
+	}
+
+	key := strings.ToLower(entities.FQDN(entry.Name))
+	set := s.names
+	if rest, ok := strings.CutPrefix(key, "*."); ok {
+		key, set = rest, s.wildcards
+	}
+
+	for _, value := range entry.Values {
+		record, err := entities.ParseRecord(entry.Name, rtype, entry.TTL, value)
+		if err != nil {
+			return err
+		}
+		if set[key] == nil {
+			set[key] = make(map[dnsmessage.Type][]entities.Record)
+		}
+		set[key][rtype] = append(set[key][rtype], record)
+	}
+
+	for parent := key; parent != "."; {
+		_, rest, _ := strings.Cut(parent, ".")
+		parent = entities.FQDN(rest)
+		s.parents[parent] = true
+	}
+
+	// A CNAME owner cannot have other data, RFC 1034 section 3.6.2
+	if types := set[key]; len(types[dnsmessage.TypeCNAME]) > 0 && (len(types) > 1 || len(types[dnsmessage.TypeCNAME]) > 1) {
+		return fmt.Errorf("%s: CNAME cannot coexist with other records", entry.Name)
+	}
+	return nil
+}
+
+// Lookup returns the local answer for a question and whether the name is local at all.
+// A local name without records of the type is NODATA; a local CNAME is returned for any
+// type so the caller can follow it. Wildcards only match names that have nothing closer
+// configured, as in RFC 4592.
+func (s *Store) Lookup(name dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, bool) {
+	if s == nil {
+		return entities.Result{}, false
+	}
+
+	key := strings.ToLower(name.String())
+	if types, ok := s.names[key]; ok {
+		return s.answer(types, name, rtype, false), true
+	}
+	if s.parents[key] {
+		// An empty non-terminal, no wildcard covers it
+		return entities.Result{}, false
+	}
+
+	// Closest configured ancestor decides whether a wildcard applies
+	for parent := key; parent != "."; {
+		_, rest, _ := strings.Cut(parent, ".")
+		parent = entities.FQDN(rest)
+
+		if types, ok := s.wildcards[parent]; ok {
+			return s.answer(types, name, rtype, true), true
+		}
+		if _, ok := s.names[parent]; ok || s.parents[parent] {
+			break
+		}
+	}
+
+	return entities.Result{}, false
+}
+
+func (s *Store) answer(types map[dnsmessage.Type][]entities.Record, name dnsmessage.Name, rtype dnsmessage.Type, wildcard bool) entities.Result {
+	records := types[rtype]
+	if len(records) == 0 && rtype != dnsmessage.TypeCNAME {
+		records = types[dnsmessage.TypeCNAME]
+	}
+
+	result := entities.Result{RCode: dnsmessage.RCodeSuccess, Authoritative: true}
+	for _, record := range records {
+		if wildcard {
+			// Synthesized records carry the name that was asked for
+			record.Name = name
+		}
+		result.Answers = append(result.Answers, record)
+	}
+
+	// NODATA carries an SOA so it can be cached, RFC 2308 section 2.2
+	if len(result.Answers) == 0 {
+		result.Authority = []entities.Record{s.soa(name, types)}
+	}
+	return result
+}
+
+// The configured SOA of the closest enclosing name, or a made up one at the name whose
+// TTL and minimum are the lowest TTL of its records (RFC 2308 section 5).
+func (s *Store) soa(name dnsmessage.Name, types map[dnsmessage.Type][]entities.Record) entities.Record {
+	for key := strings.ToLower(name.String()); ; {
+		if records := s.names[key][dnsmessage.TypeSOA]; len(records) > 0 {
+			soa := records[0]
+			soa.TTL = min(soa.TTL, soa.Body.(*dnsmessage.SOAResource).MinTTL)
+			return soa
+		}
+		if key == "." {
+			break
+		}
+		_, rest, _ := strings.Cut(key, ".")
+		key = entities.FQDN(rest)
+	}
+
+	ttl := uint32(math.MaxUint32)
+	for _, records := range types {
+		for _, record := range records {
+			ttl = min(ttl, record.TTL)
+		}
+	}
+	return entities.Record{
+		Name:  name,
+		RType: dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("local.invalid."),
+			MBox:    dnsmessage.MustNewName("nobody.invalid."),
+			Serial:  1,
+			Refresh: ttl,
+			Retry:   ttl,
+			Expire:  ttl,
+			MinTTL:  ttl,
+		},
+	}
+}
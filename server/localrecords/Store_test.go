@@ -0,0 +1,178 @@
+package localrecords
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testStore(t *testing.T, entries ...Entry) *Store {
+	t.Helper()
+	store := NewStore()
+	for _, entry := range entries {
+		if entry.TTL == 0 {
+			entry.TTL = DefaultTTL
+		}
+		if err := store.Add(entry); err != nil {
+			t.Fatalf("Failed to add %v: %v", entry, err)
+		}
+	}
+	return store
+}
+
+func Test_Lookup(t *testing.T) {
+	store := testStore(t,
+		Entry{Name: "*.home", Type: "A", Values: []string{"192.0.2.1"}},
+		Entry{Name: "nas.home", Type: "A", Values: []string{"192.0.2.10"}},
+		Entry{Name: "*.nas.home", Type: "A", Values: []string{"192.0.2.11"}},
+		Entry{Name: "printer.lab.home", Type: "TXT", Values: []string{"x"}},
+		Entry{Name: "docs.home", Type: "CNAME", Values: []string{"example.com"}},
+	)
+
+	tests := []struct {
+		name  string
+		rtype dnsmessage.Type
+		found bool
+		// Answer RDATA, empty for NODATA
+		want string
+	}{
+		{name: "nas.home.", rtype: dnsmessage.TypeA, found: true, want: "192.0.2.10"},
+		{name: "NAS.Home.", rtype: dnsmessage.TypeA, found: true, want: "192.0.2.10"},
+		{name: "tv.home.", rtype: dnsmessage.TypeA, found: true, want: "192.0.2.1"},
+		{name: "a.b.home.", rtype: dnsmessage.TypeA, found: true, want: "192.0.2.1"},
+		// The closer wildcard wins
+		{name: "disk.nas.home.", rtype: dnsmessage.TypeA, found: true, want: "192.0.2.11"},
+		// The wildcard does not cover its own parent
+		{name: "home.", rtype: dnsmessage.TypeA},
+		// An existing name blocks the wildcard above it, for itself and below
+		{name: "printer.lab.home.", rtype: dnsmessage.TypeA, found: true},
+		{name: "x.printer.lab.home.", rtype: dnsmessage.TypeA},
+		// Empty non-terminals exist too, the wildcard covers neither them nor names below
+		{name: "lab.home.", rtype: dnsmessage.TypeA},
+		{name: "scanner.lab.home.", rtype: dnsmessage.TypeA},
+		{name: "nas.home.", rtype: dnsmessage.TypeAAAA, found: true},
+		{name: "docs.home.", rtype: dnsmessage.TypeA, found: true, want: "example.com."},
+		{name: "docs.home.", rtype: dnsmessage.TypeCNAME, found: true, want: "example.com."},
+		{name: "example.com.", rtype: dnsmessage.TypeA},
+	}
+
+	for _, tt := range tests {
+		result, found := store.Lookup(dnsmessage.MustNewName(tt.name), tt.rtype)
+		if found != tt.found {
+			t.Errorf("%s %s: expected found=%v, got %v", tt.name, tt.rtype, tt.found, found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if !result.Authoritative || result.RCode != dnsmessage.RCodeSuccess {
+			t.Errorf("%s %s: expected an authoritative NOERROR, got %s AA=%v", tt.name, tt.rtype, result.RCode, result.Authoritative)
+		}
+
+		if tt.want == "" {
+			if len(result.Answers) != 0 || len(result.Authority) != 1 || result.Authority[0].RType != dnsmessage.TypeSOA {
+				t.Errorf("%s %s: expected NODATA with an SOA, got %v / %v", tt.name, tt.rtype, result.Answers, result.Authority)
+			}
+			continue
+		}
+		if len(result.Answers) != 1 || len(result.Authority) != 0 {
+			t.Errorf("%s %s: expected one answer, got %v / %v", tt.name, tt.rtype, result.Answers, result.Authority)
+			continue
+		}
+		answer := result.Answers[0]
+		if !strings.EqualFold(answer.Name.String(), tt.name) {
+			t.Errorf("%s %s: expected the answer owned by the question name, got %s", tt.name, tt.rtype, answer.Name)
+		}
+		var got string
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			got = answer.IP().String()
+		case *dnsmessage.CNAMEResource:
+			got = body.CNAME.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: expected %s, got %s", tt.name, tt.rtype, tt.want, got)
+		}
+	}
+}
+
+func Test_NoDataSOA(t *testing.T) {
+	store := testStore(t,
+		Entry{Name: "nas.home", Type: "A", TTL: 60, Values: []string{"192.0.2.10"}},
+		Entry{Name: "nas.home", Type: "TXT", TTL: 30, Values: []string{"x"}},
+		Entry{Name: "corp", Type: "SOA", TTL: 3600, Values: []string{"ns.corp. hostmaster.corp. 1 3600 600 86400 120"}},
+		Entry{Name: "www.corp", Type: "A", Values: []string{"192.0.2.20"}},
+	)
+
+	// Without an SOA above, a made up one at the name with its lowest TTL
+	result, _ := store.Lookup(dnsmessage.MustNewName("nas.home."), dnsmessage.TypeAAAA)
+	soa := result.Authority[0]
+	if soa.Name.String() != "nas.home." || soa.TTL != 30 || soa.Body.(*dnsmessage.SOAResource).MinTTL != 30 {
+		t.Errorf("Expected a made up SOA at nas.home. with TTL 30, got %s %d %v", soa.Name, soa.TTL, soa.Body)
+	}
+
+	// The configured SOA of the enclosing name, its TTL capped at the minimum
+	result, _ = store.Lookup(dnsmessage.MustNewName("www.corp."), dnsmessage.TypeAAAA)
+	soa = result.Authority[0]
+	if soa.Name.String() != "corp." || soa.TTL != 120 {
+		t.Errorf("Expected the corp. SOA with TTL 120, got %s %d", soa.Name, soa.TTL)
+	}
+}
+
+func Test_AddRejects(t *testing.T) {
+	tests := []Entry{
+		{Name: "a.home", Type: "NAPTR", Values: []string{"x"}},
+		{Name: "a.home", Type: "A"},
+		{Name: "a.home", Type: "A", Values: []string{"not an address"}},
+		{Name: "a.home", Type: "CNAME", Values: []string{"b.home", "c.home"}},
+	}
+	for _, entry := range tests {
+		if err := NewStore().Add(entry); err == nil {
+			t.Errorf("Expected %v to be rejected", entry)
+		}
+	}
+
+	// A CNAME next to other data at the same owner
+	store := testStore(t, Entry{Name: "a.home", Type: "A", Values: []string{"192.0.2.1"}})
+	if err := store.Add(Entry{Name: "a.home", Type: "CNAME", Values: []string{"b.home"}}); err == nil {
+		t.Error("Expected a CNAME beside an A record to be rejected")
+	}
+}
+
+func Test_LoadFormats(t *testing.T) {
+	files := map[string]string{
+		"local.json": `{"ttl": 60, "records": [{"name": "nas.home", "type": "A", "values": ["192.0.2.10"]}]}`,
+		"local.yaml": "ttl: 60\nrecords:\n  - {name: nas.home, type: A, values: [192.0.2.10]}\n",
+		"local.yml":  "ttl: 60\nrecords:\n  - name: nas.home\n    type: A\n    values:\n      - 192.0.2.10\n",
+		"local.toml": "ttl = 60\n\n[[records]]\nname = \"nas.home\"\ntype = \"A\"\nvalues = [\"192.0.2.10\"]\n",
+	}
+
+	dir := t.TempDir()
+	for file, content := range files {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := Load(path)
+		if err != nil {
+			t.Errorf("%s: failed to load: %v", file, err)
+			continue
+		}
+		result, found := store.Lookup(dnsmessage.MustNewName("nas.home."), dnsmessage.TypeA)
+		if !found || len(result.Answers) != 1 || result.Answers[0].TTL != 60 || result.Answers[0].IP().String() != "192.0.2.10" {
+			t.Errorf("%s: expected nas.home. A 192.0.2.10 with TTL 60, got %v", file, result.Answers)
+		}
+	}
+
+	// Anything else is parsed as JSON
+	path := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(path, []byte(files["local.toml"]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Expected TOML in a .json file to fail")
+	}
+}
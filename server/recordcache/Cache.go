@@ -9,22 +9,48 @@ import (
 )
 
 type Cache struct {
-	mu      sync.RWMutex
-	records map[string][]entities.Record
+	mu       sync.RWMutex
+	records  map[string][]entities.Record
+	negative map[string]negativeEntry
+	done     chan struct{} // stops the cleanup goroutine
+	close    sync.Once
+}
+
+// negativeEntry remembers an NXDOMAIN or NODATA answer, RFC 2308.
+type negativeEntry struct {
+	rcode    dnsmessage.RCode
+	soa      []entities.Record
+	expireAt time.Time
 }
 
 func NewCache() *Cache {
 	c := &Cache{
-		records: make(map[string][]entities.Record),
+		records:  make(map[string][]entities.Record),
+		negative: make(map[string]negativeEntry),
+		done:     make(chan struct{}),
 	}
 	go c.cleanupExpiredRecords()
 	return c
 }
 
+// Close stops the hourly cleanup. The cache still answers, expired entries are then
+// only dropped when they are looked up.
+func (c *Cache) Close() {
+	c.close.Do(func() { close(c.done) })
+}
+
 func generateKey(name dnsmessage.Name, rtype dnsmessage.Type) string {
 	return fmt.Sprintf("%s:%d", name.String(), rtype)
 }
 
+// NXDOMAIN applies to every type at the name, NODATA only to one type.
+func generateNegativeKey(name dnsmessage.Name, rtype dnsmessage.Type, rcode dnsmessage.RCode) string {
+	if rcode == dnsmessage.RCodeNameError {
+		return fmt.Sprintf("%s:NXDOMAIN", name.String())
+	}
+	return generateKey(name, rtype)
+}
+
 func (c *Cache) Set(record entities.Record) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -32,10 +58,14 @@ func (c *Cache) Set(record entities.Record) {
 	key := generateKey(record.Name, record.RType)
 	record.ExpireAt = time.Now().Add(time.Duration(record.TTL) * time.Second)
 
+	// Data for the name supersedes whatever negative answer was cached before
+	delete(c.negative, key)
+	delete(c.negative, generateNegativeKey(record.Name, record.RType, dnsmessage.RCodeNameError))
+
 	existingRecords, exists := c.records[key]
 	if exists {
 		for _, existingRecord := range existingRecords {
-			if existingRecord.IP.Equal(record.IP) {
+			if existingRecord.Equal(record) {
 				return
 			}
 		}
@@ -44,40 +74,106 @@ func (c *Cache) Set(record entities.Record) {
 	c.records[key] = append(c.records[key], record)
 }
 
-func (c *Cache) Get(name dnsmessage.Name, rtype dnsmessage.Type) ([]entities.Record, bool) {
+// SetNegative caches an NXDOMAIN or NODATA result for the name. Answers without
+// an SOA are not cached (RFC 2308 section 5), the TTL is the lesser of the SOA TTL and its MINIMUM field.
+func (c *Cache) SetNegative(name dnsmessage.Name, rtype dnsmessage.Type, result entities.Result) {
+	var ttl uint32
+	var soa []entities.Record
+	for _, record := range result.Authority {
+		body, ok := record.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl = min(record.TTL, body.MinTTL)
+		soa = append(soa, record)
+	}
+	if len(soa) == 0 || ttl == 0 {
+		return
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	for i := range soa {
+		soa[i].ExpireAt = expireAt
+	}
+
+	c.negative[generateNegativeKey(name, rtype, result.RCode)] = negativeEntry{
+		rcode:    result.RCode,
+		soa:      soa,
+		expireAt: expireAt,
+	}
+}
+
+// Get returns the cached answer for name and type, either records or a negative
+// result with its SOA. TTLs are counted down to the time remaining.
+func (c *Cache) Get(name dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for _, key := range []string{
+		generateNegativeKey(name, rtype, dnsmessage.RCodeNameError),
+		generateNegativeKey(name, rtype, dnsmessage.RCodeSuccess),
+	} {
+		entry, exists := c.negative[key]
+		if !exists {
+			continue
+		}
+		if !now.Before(entry.expireAt) {
+			delete(c.negative, key)
+			continue
+		}
+
+		result := entities.Result{RCode: entry.rcode}
+		for _, record := range entry.soa {
+			record.TTL = remainingTTL(record.ExpireAt, now)
+			result.Authority = append(result.Authority, record)
+		}
+		return result, true
+	}
+
 	key := generateKey(name, rtype)
 	records, exists := c.records[key]
 	if !exists {
-		return nil, false
+		return entities.Result{}, false
 	}
 
 	validRecords := []entities.Record{}
-	now := time.Now()
 	for _, record := range records {
-		remainingTTL := uint32(record.ExpireAt.Sub(now).Seconds())
-		if remainingTTL > 0 {
-			record.TTL = remainingTTL
+		if now.Before(record.ExpireAt) {
+			record.TTL = remainingTTL(record.ExpireAt, now)
 			validRecords = append(validRecords, record)
 		}
 	}
 
 	if len(validRecords) == 0 {
 		delete(c.records, key)
-		return nil, false
+		return entities.Result{}, false
 	}
 
 	c.records[key] = validRecords
-	return validRecords, true
+	return entities.Result{Answers: validRecords}, true
+}
+
+// Whole seconds left until expireAt, rounded up so a live record never reports a zero TTL.
+func remainingTTL(expireAt time.Time, now time.Time) uint32 {
+	return uint32((expireAt.Sub(now) + time.Second - 1) / time.Second)
 }
 
 func (c *Cache) cleanupExpiredRecords() {
 	ticker := time.NewTicker(time.Hour) // Run every hour
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
 		c.mu.Lock()
 		now := time.Now()
 		for key, records := range c.records {
@@ -93,6 +189,11 @@ func (c *Cache) cleanupExpiredRecords() {
 				c.records[key] = validRecords
 			}
 		}
+		for key, entry := range c.negative {
+			if !now.Before(entry.expireAt) {
+				delete(c.negative, key)
+			}
+		}
 		c.mu.Unlock()
 	}
 }
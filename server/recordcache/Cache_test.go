@@ -0,0 +1,125 @@
+package recordcache
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+	"time"
+)
+
+var (
+	name  = dnsmessage.MustNewName("www.example.com.")
+	other = dnsmessage.MustNewName("mail.example.com.")
+)
+
+func soaRecord(ttl, minTTL uint32) entities.Record {
+	return entities.Record{
+		Name:  dnsmessage.MustNewName("example.com."),
+		RType: dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+		Body:  &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("h.example.com."), MinTTL: minTTL},
+	}
+}
+
+func aRecord(owner dnsmessage.Name, ttl uint32) entities.Record {
+	return entities.Record{Name: owner, RType: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}
+}
+
+func Test_SetNegative(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcode     dnsmessage.RCode
+		authority []entities.Record
+		// Whether the answer is cached for A and for AAAA at the name
+		cachedA, cachedAAAA bool
+		ttl                 uint32
+	}{
+		{name: "NXDOMAIN covers every type", rcode: dnsmessage.RCodeNameError, authority: []entities.Record{soaRecord(300, 60)}, cachedA: true, cachedAAAA: true, ttl: 60},
+		{name: "NODATA covers one type", rcode: dnsmessage.RCodeSuccess, authority: []entities.Record{soaRecord(300, 60)}, cachedA: true, ttl: 60},
+		{name: "SOA TTL below its minimum", rcode: dnsmessage.RCodeNameError, authority: []entities.Record{soaRecord(30, 600)}, cachedA: true, cachedAAAA: true, ttl: 30},
+		{name: "no SOA, not cached", rcode: dnsmessage.RCodeNameError},
+		{name: "zero TTL, not cached", rcode: dnsmessage.RCodeSuccess, authority: []entities.Record{soaRecord(300, 0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache()
+			c.SetNegative(name, dnsmessage.TypeA, entities.Result{RCode: tt.rcode, Authority: tt.authority})
+
+			result, found := c.Get(name, dnsmessage.TypeA)
+			if found != tt.cachedA {
+				t.Fatalf("Expected A cached=%v, got %v", tt.cachedA, found)
+			}
+			if _, found := c.Get(name, dnsmessage.TypeAAAA); found != tt.cachedAAAA {
+				t.Errorf("Expected AAAA cached=%v, got %v", tt.cachedAAAA, found)
+			}
+			if !found {
+				return
+			}
+			if result.RCode != tt.rcode || len(result.Authority) != 1 {
+				t.Errorf("Expected %s with the SOA, got %s with %d authority records", tt.rcode, result.RCode, len(result.Authority))
+			}
+			if result.Authority[0].TTL != tt.ttl {
+				t.Errorf("Expected the SOA TTL to be %d, got %d", tt.ttl, result.Authority[0].TTL)
+			}
+			if _, found := c.Get(other, dnsmessage.TypeA); found {
+				t.Error("Expected other names to be unaffected")
+			}
+		})
+	}
+}
+
+func Test_SetSupersedesNegative(t *testing.T) {
+	c := NewCache()
+	c.SetNegative(name, dnsmessage.TypeA, entities.Result{RCode: dnsmessage.RCodeNameError, Authority: []entities.Record{soaRecord(300, 300)}})
+	c.Set(aRecord(name, 120))
+
+	result, found := c.Get(name, dnsmessage.TypeA)
+	if !found || result.RCode != dnsmessage.RCodeSuccess || len(result.Answers) != 1 {
+		t.Fatalf("Expected the new A record instead of NXDOMAIN, got %+v", result)
+	}
+	if _, found := c.Get(name, dnsmessage.TypeAAAA); found {
+		t.Error("Expected the NXDOMAIN for other types to be gone too")
+	}
+}
+
+func Test_SetDeduplicates(t *testing.T) {
+	c := NewCache()
+	c.Set(aRecord(name, 120))
+	c.Set(aRecord(name, 300))
+
+	result, _ := c.Get(name, dnsmessage.TypeA)
+	if len(result.Answers) != 1 {
+		t.Errorf("Expected one record for equal data, got %d", len(result.Answers))
+	}
+}
+
+func Test_RemainingTTL(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		left time.Duration
+		want uint32
+	}{
+		{left: 60 * time.Second, want: 60},
+		{left: 59*time.Second + time.Millisecond, want: 60},
+		{left: time.Millisecond, want: 1}, // never zero while the record lives
+		{left: 0, want: 0},
+	}
+	for _, tt := range tests {
+		if got := remainingTTL(now.Add(tt.left), now); got != tt.want {
+			t.Errorf("Expected %d seconds for %s left, got %d", tt.want, tt.left, got)
+		}
+	}
+}
+
+func Test_CloseKeepsCache(t *testing.T) {
+	c := NewCache()
+	c.Close()
+	c.Close() // twice is fine
+
+	c.Set(aRecord(name, 60))
+	if _, found := c.Get(name, dnsmessage.TypeA); !found {
+		t.Error("Expected a closed cache to keep answering")
+	}
+}
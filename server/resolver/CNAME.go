@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"context"
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+)
+
+// MaxCNAMEChain is how many aliases are followed before giving up, same default as BIND and Unbound
+const MaxCNAMEChain = 8
+
+var (
+	ErrCNAMELoop    = errors.New("CNAME loop")
+	ErrCNAMETooLong = errors.New("CNAME chain too long")
+)
+
+// Resolve domainName and follow any CNAME, chain holds the aliases already visited.
+// The result lists the chain in order: alias CNAME target, then the target's records.
+func (r *Resolver) resolveChain(ctx context.Context, domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type, chain []dnsmessage.Name) (entities.Result, error) {
+	for _, alias := range chain {
+		if sameName(alias, domainName) {
+			return entities.Result{}, ErrCNAMELoop
+		}
+	}
+	result, err := r.lookup(ctx, domainName, id, rtype)
+	if err != nil {
+		return entities.Result{}, err
+	}
+
+	// A CNAME question is answered by the alias itself
+	if rtype == dnsmessage.TypeCNAME {
+		return result, nil
+	}
+
+	for _, record := range result.Answers {
+		cname, ok := record.Body.(*dnsmessage.CNAMEResource)
+		if !ok {
+			continue
+		}
+		// Following this alias makes one more than the chain so far
+		if len(chain) >= MaxCNAMEChain {
+			return entities.Result{}, ErrCNAMETooLong
+		}
+
+		// The RCODE and authority of the reply describe the last name of the chain, RFC 6604
+		target, err := r.resolveChain(ctx, cname.CNAME, id, rtype, append(chain, domainName))
+		if err != nil {
+			return entities.Result{}, fmt.Errorf("resolving CNAME target %s: %w", cname.CNAME.String(), err)
+		}
+		target.Answers = append(append([]entities.Record{}, result.Answers...), target.Answers...)
+		return target, nil
+	}
+
+	return result, nil
+}
+
+// Collect the chain for domainName from a single answer section: the CNAMEs
+// leading away from it and the requested records at the end, in order. At most
+// MaxCNAMEChain aliases are taken, a longer chain is cut off there.
+func chainAnswers(answers []dnsmessage.Resource, domainName dnsmessage.Name, rtype dnsmessage.Type) []entities.Record {
+	var records []entities.Record
+	owner := domainName
+	for i := 0; i <= MaxCNAMEChain; i++ {
+		var next *dnsmessage.Name
+		for _, answer := range answers {
+			if !sameName(answer.Header.Name, owner) {
+				continue
+			}
+
+			if answer.Header.Type == rtype {
+				records = append(records, entities.NewRecord(answer))
+			} else if answer.Header.Type == dnsmessage.TypeCNAME && next == nil && i < MaxCNAMEChain {
+				records = append(records, entities.NewRecord(answer))
+				target := answer.Body.(*dnsmessage.CNAMEResource).CNAME
+				next = &target
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		owner = *next
+	}
+
+	return records
+}
+
+// Whether the chain ends in records of the requested type.
+func answersQuestion(records []entities.Record, rtype dnsmessage.Type) bool {
+	for _, rec := range records {
+		if rec.RType == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Last name of the chain leading away from domainName in records, domainName itself
+// when it has no CNAME. A chain longer than MaxCNAMEChain, or looping, has no end.
+func chainEnd(records []entities.Record, domainName dnsmessage.Name) (dnsmessage.Name, bool) {
+	owner := domainName
+	for i := 0; i <= MaxCNAMEChain; i++ {
+		var next *dnsmessage.Name
+		for _, rec := range records {
+			if cname, ok := rec.Body.(*dnsmessage.CNAMEResource); ok && sameName(rec.Name, owner) {
+				next = &cname.CNAME
+				break
+			}
+		}
+		if next == nil {
+			return owner, true
+		}
+		owner = *next
+	}
+	return dnsmessage.Name{}, false
+}
+
+// Records in result that belong to domainName.
+func ownedBy(result []entities.Record, domainName dnsmessage.Name) []entities.Record {
+	var records []entities.Record
+	for _, rec := range result {
+		if sameName(rec.Name, domainName) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// Address of the first A or AAAA record in a resolved chain.
+func firstIP(records []entities.Record) net.IP {
+	for _, rec := range records {
+		if ip := rec.IP(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Domain names compare case-insensitively, RFC 4343.
+func sameName(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
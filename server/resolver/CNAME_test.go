@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"context"
+	"dnsthingymagik/server/recordcache"
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"testing"
+)
+
+func cnameResource(owner, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(owner), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func aResource(owner string, last byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(owner), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, last}},
+	}
+}
+
+// Owner and type of each record, for comparing chains.
+func describe(records []entities.Record) string {
+	var parts []string
+	for _, record := range records {
+		parts = append(parts, fmt.Sprintf("%s %s", record.Name, strings.TrimPrefix(record.RType.String(), "Type")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Names a0.test. to an.test., each an alias of the next.
+func aliases(n int) []dnsmessage.Resource {
+	var chain []dnsmessage.Resource
+	for i := 0; i < n; i++ {
+		chain = append(chain, cnameResource(fmt.Sprintf("a%d.test.", i), fmt.Sprintf("a%d.test.", i+1)))
+	}
+	return chain
+}
+
+func Test_ChainAnswers(t *testing.T) {
+	a := dnsmessage.TypeA
+	tests := []struct {
+		name    string
+		answers []dnsmessage.Resource
+		want    string
+	}{
+		{
+			name:    "in order",
+			answers: []dnsmessage.Resource{cnameResource("www.test.", "cdn.test."), aResource("cdn.test.", 1)},
+			want:    "www.test. CNAME, cdn.test. A",
+		},
+		{
+			name:    "out of order",
+			answers: []dnsmessage.Resource{aResource("cdn.test.", 1), aResource("edge.test.", 2), cnameResource("cdn.test.", "x.test."), cnameResource("www.test.", "edge.test.")},
+			want:    "www.test. CNAME, edge.test. A",
+		},
+		{
+			name:    "unrelated records are dropped",
+			answers: []dnsmessage.Resource{aResource("other.test.", 1), aResource("www.test.", 2)},
+			want:    "www.test. A",
+		},
+		{
+			name:    "names compare case-insensitively",
+			answers: []dnsmessage.Resource{cnameResource("WWW.Test.", "CDN.test."), aResource("cdn.TEST.", 1)},
+			want:    "WWW.Test. CNAME, cdn.TEST. A",
+		},
+		{
+			name:    "only the first CNAME of a name is followed",
+			answers: []dnsmessage.Resource{cnameResource("www.test.", "one.test."), cnameResource("www.test.", "two.test."), aResource("two.test.", 1), aResource("one.test.", 2)},
+			want:    "www.test. CNAME, one.test. A",
+		},
+		{
+			name:    "a loop is cut off at the limit",
+			answers: []dnsmessage.Resource{cnameResource("www.test.", "cdn.test."), cnameResource("cdn.test.", "www.test.")},
+			want:    "www.test. CNAME, cdn.test. CNAME, www.test. CNAME, cdn.test. CNAME, www.test. CNAME, cdn.test. CNAME, www.test. CNAME, cdn.test. CNAME",
+		},
+		{
+			name:    "NXDOMAIN or NODATA at the end",
+			answers: []dnsmessage.Resource{cnameResource("www.test.", "gone.test.")},
+			want:    "www.test. CNAME",
+		},
+	}
+	for _, tt := range tests {
+		if got := describe(chainAnswers(tt.answers, dnsmessage.MustNewName("www.test."), a)); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	// A longer chain than the limit is cut off after MaxCNAMEChain aliases
+	long := append(aliases(MaxCNAMEChain+2), aResource(fmt.Sprintf("a%d.test.", MaxCNAMEChain+2), 1))
+	got := chainAnswers(long, dnsmessage.MustNewName("a0.test."), a)
+	if len(got) != MaxCNAMEChain || got[len(got)-1].RType != dnsmessage.TypeCNAME {
+		t.Errorf("Expected %d aliases, got %s", MaxCNAMEChain, describe(got))
+	}
+}
+
+// A resolver answering only from its cache, filled with the given records.
+func cachedResolver(t *testing.T, resources ...dnsmessage.Resource) *Resolver {
+	t.Helper()
+	cache := recordcache.NewCache()
+	t.Cleanup(cache.Close)
+	for _, resource := range resources {
+		cache.Set(entities.NewRecord(resource))
+	}
+	r := NewResolver(cache)
+	// Anything missing from the cache would go to the roots, fail right away instead
+	r.roots.set(nil)
+	return r
+}
+
+func Test_ResolveChain(t *testing.T) {
+	a := dnsmessage.TypeA
+	atLimit := append(aliases(MaxCNAMEChain), aResource(fmt.Sprintf("a%d.test.", MaxCNAMEChain), 1))
+	overLimit := append(aliases(MaxCNAMEChain+1), aResource(fmt.Sprintf("a%d.test.", MaxCNAMEChain+1), 1))
+
+	tests := []struct {
+		name      string
+		records   []dnsmessage.Resource
+		question  string
+		rtype     dnsmessage.Type
+		want      string
+		err       error
+		aliasesIn int // number of CNAMEs expected in the answer, when no error
+	}{
+		{
+			name:     "chain in order",
+			records:  []dnsmessage.Resource{aResource("c.test.", 1), cnameResource("b.test.", "c.test."), cnameResource("a.test.", "b.test.")},
+			question: "a.test.",
+			rtype:    a,
+			want:     "a.test. CNAME, b.test. CNAME, c.test. A",
+		},
+		{
+			name:     "CNAME question stops at the alias",
+			records:  []dnsmessage.Resource{aResource("b.test.", 1), cnameResource("a.test.", "b.test.")},
+			question: "a.test.",
+			rtype:    dnsmessage.TypeCNAME,
+			want:     "a.test. CNAME",
+		},
+		{
+			name:     "loop",
+			records:  []dnsmessage.Resource{cnameResource("a.test.", "b.test."), cnameResource("b.test.", "A.test.")},
+			question: "a.test.",
+			rtype:    a,
+			err:      ErrCNAMELoop,
+		},
+		{
+			name:     "self loop",
+			records:  []dnsmessage.Resource{cnameResource("a.test.", "a.test.")},
+			question: "a.test.",
+			rtype:    a,
+			err:      ErrCNAMELoop,
+		},
+		{
+			name:      "as many aliases as the limit",
+			records:   atLimit,
+			question:  "a0.test.",
+			rtype:     a,
+			aliasesIn: MaxCNAMEChain,
+		},
+		{
+			name:     "one alias more than the limit",
+			records:  overLimit,
+			question: "a0.test.",
+			rtype:    a,
+			err:      ErrCNAMETooLong,
+		},
+	}
+
+	for _, tt := range tests {
+		r := cachedResolver(t, tt.records...)
+		result, err := r.resolveChain(context.Background(), dnsmessage.MustNewName(tt.question), 1, tt.rtype, nil)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: expected %v, got %v (%s)", tt.name, tt.err, err, describe(result.Answers))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.want != "" && describe(result.Answers) != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, describe(result.Answers))
+		}
+		if tt.aliasesIn > 0 {
+			cnames := 0
+			for _, record := range result.Answers {
+				if record.RType == dnsmessage.TypeCNAME {
+					cnames++
+				}
+			}
+			if cnames != tt.aliasesIn || !answersQuestion(result.Answers, tt.rtype) {
+				t.Errorf("%s: expected %d aliases and the address, got %s", tt.name, tt.aliasesIn, describe(result.Answers))
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"sync"
+)
+
+// call is one upstream resolution that concurrent identical questions wait for.
+type call struct {
+	done   chan struct{}
+	result entities.Result
+	err    error
+	dups   int // callers that joined after the first, guarded by the group's mu
+}
+
+// flightGroup coalesces concurrent resolutions of the same question into one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*call)}
+}
+
+func flightKey(name dnsmessage.Name, rtype dnsmessage.Type, class dnsmessage.Class) string {
+	return fmt.Sprintf("%s:%d:%d", strings.ToLower(name.String()), rtype, class)
+}
+
+// Run fn once per key at a time, callers arriving while it runs get the same result.
+// The result is shared, callers must not modify its slices.
+func (g *flightGroup) do(key string, fn func() (entities.Result, error)) (entities.Result, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		<-c.done
+		return c.result, c.err
+	}
+
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.result, c.err = fn()
+	return c.result, c.err
+}
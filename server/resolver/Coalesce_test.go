@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_FlightKey(t *testing.T) {
+	upper := flightKey(dnsmessage.MustNewName("WWW.Example.COM."), dnsmessage.TypeA, dnsmessage.ClassINET)
+	lower := flightKey(dnsmessage.MustNewName("www.example.com."), dnsmessage.TypeA, dnsmessage.ClassINET)
+	if upper != lower {
+		t.Errorf("Expected names to compare case-insensitively, got %q and %q", upper, lower)
+	}
+
+	for _, other := range []string{
+		flightKey(dnsmessage.MustNewName("www.example.com."), dnsmessage.TypeAAAA, dnsmessage.ClassINET),
+		flightKey(dnsmessage.MustNewName("www.example.com."), dnsmessage.TypeA, dnsmessage.ClassCHAOS),
+	} {
+		if other == lower {
+			t.Errorf("Expected type and class to be part of the key, got %q twice", other)
+		}
+	}
+}
+
+func Test_FlightGroupCoalesces(t *testing.T) {
+	g := newFlightGroup()
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	fn := func() (entities.Result, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return entities.Result{RCode: dnsmessage.RCodeNameError}, nil
+	}
+
+	// The first caller is inside fn before the others arrive
+	const waiters = 10
+	results := make(chan entities.Result, waiters+1)
+	go func() {
+		result, _ := g.do("key", fn)
+		results <- result
+	}()
+	<-started
+
+	for i := 0; i < waiters; i++ {
+		go func() {
+			result, _ := g.do("key", fn)
+			results <- result
+		}()
+	}
+	// Release the first call only once everyone joined it
+	for joined := 0; joined < waiters; {
+		runtime.Gosched()
+		g.mu.Lock()
+		joined = g.calls["key"].dups
+		g.mu.Unlock()
+	}
+	close(release)
+
+	for i := 0; i < waiters+1; i++ {
+		if result := <-results; result.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("Expected every caller to get the shared result, got %s", result.RCode)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected one resolution for concurrent callers, got %d", n)
+	}
+}
+
+func Test_FlightGroupForgetsFinishedCalls(t *testing.T) {
+	g := newFlightGroup()
+	failed := errors.New("timeout")
+
+	_, err := g.do("key", func() (entities.Result, error) { return entities.Result{}, failed })
+	if !errors.Is(err, failed) {
+		t.Errorf("Expected the error to reach the caller, got %v", err)
+	}
+
+	// A later call resolves again instead of reusing the failure
+	result, err := g.do("key", func() (entities.Result, error) { return entities.Result{RCode: dnsmessage.RCodeSuccess}, nil })
+	if err != nil || result.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected a fresh resolution, got %v %v", result.RCode, err)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("Expected no calls left in flight, got %d", len(g.calls))
+	}
+}
@@ -0,0 +1,72 @@
+package resolver
+
+import (
+	"dnsthingymagik/server/recordcache"
+	"dnsthingymagik/server/resolver/entities"
+	"golang.org/x/net/dns/dnsmessage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// conditionalRule sends everything at or below zone to its own servers,
+// answers are kept apart from the main cache.
+type conditionalRule struct {
+	zone      dnsmessage.Name
+	cache     *recordcache.Cache
+	forwarder *forwarder
+}
+
+// AddConditionalForwarder sends questions under zone to servers instead of the usual
+// path. With skipDNSSEC the queries carry the CD bit, so validating servers answer
+// for internal zones that have no chain of trust from the public root.
+func (r *Resolver) AddConditionalForwarder(zone string, servers []string, skipDNSSEC bool, timeout time.Duration) error {
+	name, err := dnsmessage.NewName(entities.FQDN(zone))
+	if err != nil {
+		return err
+	}
+
+	f, err := newForwarder(servers, StrategySequential, timeout)
+	if err != nil {
+		return err
+	}
+	f.checkingDisabled = skipDNSSEC
+
+	r.conditional = append(r.conditional, &conditionalRule{
+		zone:      name,
+		cache:     recordcache.NewCache(),
+		forwarder: f,
+	})
+
+	// Longest suffix first, so the most specific zone wins
+	sort.SliceStable(r.conditional, func(i, j int) bool {
+		return labels(r.conditional[i].zone) > labels(r.conditional[j].zone)
+	})
+	return nil
+}
+
+// Close stops the caches made for the conditional forwarders. The cache the resolver
+// was created with belongs to the caller, who closes it.
+func (r *Resolver) Close() {
+	for _, rule := range r.conditional {
+		rule.cache.Close()
+	}
+}
+
+// The rule for the deepest configured zone containing name, nil if none.
+func (r *Resolver) conditionalRuleFor(name dnsmessage.Name) *conditionalRule {
+	for _, rule := range r.conditional {
+		if isSubdomain(name, rule.zone) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func labels(name dnsmessage.Name) int {
+	s := strings.TrimSuffix(name.String(), ".")
+	if s == "" {
+		return 0
+	}
+	return strings.Count(s, ".") + 1
+}
@@ -0,0 +1,205 @@
+package resolver
+
+import (
+	"context"
+	"dnsthingymagik/server/recordcache"
+	"dnsthingymagik/server/resolver/entities"
+	"dnsthingymagik/server/resolver/query"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides the order in which a forwarder asks its upstreams.
+type Strategy string
+
+const (
+	StrategySequential Strategy = "sequential"  // configured order, the next one only on failure
+	StrategyRoundRobin Strategy = "round-robin" // rotate the first upstream on every query
+	StrategyFastest    Strategy = "fastest"     // lowest smoothed RTT first
+	StrategyParallel   Strategy = "parallel"    // ask all at once, the first good answer wins
+
+	DefaultUpstreamTimeout = 2 * time.Second
+)
+
+var ErrNoUpstreams = errors.New("forwarding needs at least one upstream")
+
+// forwarder sends recursive (RD=1) queries to upstream resolvers instead of iterating.
+type forwarder struct {
+	upstreams []string
+	strategy  Strategy
+	timeout   time.Duration // per upstream attempt
+	next      atomic.Uint32 // round-robin position
+	health    *infraCache
+	// Set CD on queries, the upstream then skips DNSSEC validation
+	checkingDisabled bool
+}
+
+func newForwarder(upstreams []string, strategy Strategy, timeout time.Duration) (*forwarder, error) {
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+	switch strategy {
+	case "":
+		strategy = StrategySequential
+	case StrategySequential, StrategyRoundRobin, StrategyFastest, StrategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+	if timeout <= 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+
+	return &forwarder{
+		upstreams: upstreams,
+		strategy:  strategy,
+		timeout:   timeout,
+		health:    newInfraCache(),
+	}, nil
+}
+
+// NewForwardingResolver returns a resolver that sends every question to upstreams.
+func NewForwardingResolver(cache *recordcache.Cache, upstreams []string, strategy Strategy, timeout time.Duration) (*Resolver, error) {
+	f, err := newForwarder(upstreams, strategy, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewResolver(cache)
+	r.forwarder = f
+	return r, nil
+}
+
+// Ask the upstreams about domainName, the answer already contains the whole CNAME chain.
+func (f *forwarder) resolve(ctx context.Context, domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type) (entities.Result, error) {
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+			CheckingDisabled: f.checkingDisabled,
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  domainName,
+				Type:  rtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+
+	var response dnsmessage.Message
+	var err error
+	if f.strategy == StrategyParallel {
+		response, err = f.race(ctx, q)
+	} else {
+		response, err = f.sequence(ctx, q)
+	}
+	if err != nil {
+		return entities.Result{}, err
+	}
+
+	result := entities.Result{
+		RCode:   response.Header.RCode,
+		Answers: chainAnswers(response.Answers, domainName, rtype),
+	}
+	if result.RCode == dnsmessage.RCodeNameError || !answersQuestion(result.Answers, rtype) {
+		for _, authority := range response.Authorities {
+			if authority.Header.Type == dnsmessage.TypeSOA {
+				result.Authority = append(result.Authority, entities.NewRecord(authority))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Upstreams in the order the strategy asks them, unhealthy ones moved to the back.
+func (f *forwarder) order() []string {
+	switch f.strategy {
+	case StrategyFastest:
+		return f.health.order(f.upstreams)
+	case StrategyRoundRobin:
+		start := int(f.next.Add(1)-1) % len(f.upstreams)
+		rotated := append(append([]string{}, f.upstreams[start:]...), f.upstreams[:start]...)
+		return f.health.healthyFirst(rotated)
+	default:
+		return f.health.healthyFirst(f.upstreams)
+	}
+}
+
+// Try upstreams one after another until one gives a usable answer.
+func (f *forwarder) sequence(ctx context.Context, q dnsmessage.Message) (dnsmessage.Message, error) {
+	var lastErr error = ErrNoNameserver
+	for _, upstream := range f.order() {
+		if ctx.Err() != nil {
+			return dnsmessage.Message{}, fmt.Errorf("query budget exhausted: %w", lastErr)
+		}
+
+		response, err := f.ask(ctx, upstream, q)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return response, nil
+	}
+
+	return dnsmessage.Message{}, lastErr
+}
+
+// Ask every healthy upstream at once and return the first usable answer.
+func (f *forwarder) race(ctx context.Context, q dnsmessage.Message) (dnsmessage.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type reply struct {
+		response dnsmessage.Message
+		err      error
+	}
+
+	upstreams := f.health.healthy(f.upstreams)
+	replies := make(chan reply, len(upstreams))
+	for _, upstream := range upstreams {
+		go func() {
+			response, err := f.ask(ctx, upstream, q)
+			replies <- reply{response, err}
+		}()
+	}
+
+	var lastErr error = ErrNoNameserver
+	for range upstreams {
+		r := <-replies
+		if r.err == nil {
+			return r.response, nil
+		}
+		lastErr = r.err
+	}
+
+	return dnsmessage.Message{}, lastErr
+}
+
+// Send q to a single upstream and record how it went.
+func (f *forwarder) ask(ctx context.Context, upstream string, q dnsmessage.Message) (dnsmessage.Message, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	start := time.Now()
+	response, err := query.SendQuery(attemptCtx, upstream, q)
+	if err != nil {
+		// A race lost to a faster upstream is not the slower one's fault
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			f.health.failure(upstream)
+		}
+		return dnsmessage.Message{}, err
+	}
+
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		f.health.success(upstream, time.Since(start))
+		return response, nil
+	default:
+		f.health.failure(upstream)
+		return dnsmessage.Message{}, fmt.Errorf("upstream %s answered %s", upstream, response.Header.RCode)
+	}
+}
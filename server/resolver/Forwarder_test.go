@@ -0,0 +1,193 @@
+package resolver
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"slices"
+	"testing"
+	"time"
+)
+
+// An upstream answering every question with 192.0.2.last after delay.
+func answering(t *testing.T, last byte, delay time.Duration) *stubServer {
+	return newStubServer(t, func(q dnsmessage.Question) *dnsmessage.Message {
+		time.Sleep(delay)
+		return &dnsmessage.Message{
+			Header:  dnsmessage.Header{RecursionAvailable: true},
+			Answers: []dnsmessage.Resource{aResource(q.Name.String(), last)},
+		}
+	})
+}
+
+func failing(t *testing.T) *stubServer {
+	return newStubServer(t, func(dnsmessage.Question) *dnsmessage.Message {
+		return &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+}
+
+func silent(t *testing.T) *stubServer {
+	return newStubServer(t, func(dnsmessage.Question) *dnsmessage.Message { return nil })
+}
+
+func addrs(stubs ...*stubServer) []string {
+	var upstreams []string
+	for _, stub := range stubs {
+		upstreams = append(upstreams, stub.addr)
+	}
+	return upstreams
+}
+
+func counts(stubs ...*stubServer) []int {
+	var asked []int
+	for _, stub := range stubs {
+		asked = append(asked, stub.queries())
+	}
+	return asked
+}
+
+// Ask f for www.test. and return the last byte of the address it answered with.
+func forward(t *testing.T, f *forwarder) byte {
+	t.Helper()
+	result, err := f.resolve(context.Background(), dnsmessage.MustNewName("www.test."), 1, dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := firstIP(result.Answers)
+	if ip == nil {
+		t.Fatalf("Expected an address, got %s", describe(result.Answers))
+	}
+	return ip.To4()[3]
+}
+
+func Test_ForwarderSequential(t *testing.T) {
+	stubs := []*stubServer{failing(t), answering(t, 1, 0), answering(t, 2, 0)}
+	f, err := newForwarder(addrs(stubs...), StrategySequential, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := forward(t, f); got != 1 {
+		t.Errorf("Expected the first working upstream in configured order, got 192.0.2.%d", got)
+	}
+	if asked := counts(stubs...); !slices.Equal(asked, []int{1, 1, 0}) {
+		t.Errorf("Expected the next upstream only after a failure, got %v", asked)
+	}
+}
+
+func Test_ForwarderRoundRobin(t *testing.T) {
+	stubs := []*stubServer{answering(t, 1, 0), answering(t, 2, 0), answering(t, 3, 0)}
+	f, err := newForwarder(addrs(stubs...), StrategyRoundRobin, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for i := 0; i < 4; i++ {
+		got = append(got, forward(t, f))
+	}
+	if !slices.Equal(got, []byte{1, 2, 3, 1}) {
+		t.Errorf("Expected the first upstream to rotate, got %v", got)
+	}
+	if asked := counts(stubs...); !slices.Equal(asked, []int{2, 1, 1}) {
+		t.Errorf("Expected one upstream per query, got %v", asked)
+	}
+}
+
+func Test_ForwarderFastest(t *testing.T) {
+	stubs := []*stubServer{answering(t, 1, 0), answering(t, 2, 0), answering(t, 3, 0)}
+	f, err := newForwarder(addrs(stubs...), StrategyFastest, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.health.success(stubs[0].addr, 300*time.Millisecond)
+	f.health.success(stubs[1].addr, 200*time.Millisecond)
+	f.health.success(stubs[2].addr, 20*time.Millisecond)
+
+	if got := forward(t, f); got != 3 {
+		t.Errorf("Expected the lowest smoothed RTT first, got 192.0.2.%d", got)
+	}
+	if asked := counts(stubs...); !slices.Equal(asked, []int{0, 0, 1}) {
+		t.Errorf("Expected only the fastest upstream asked, got %v", asked)
+	}
+}
+
+func Test_ForwarderParallel(t *testing.T) {
+	loser, fast := silent(t), answering(t, 2, 0)
+	f, err := newForwarder(addrs(loser, fast), StrategyParallel, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if got := forward(t, f); got != 2 {
+		t.Errorf("Expected the first answer to win, got 192.0.2.%d", got)
+	}
+	if waited := time.Since(start); waited >= 200*time.Millisecond {
+		t.Errorf("Expected not to wait for the other upstream, took %s", waited)
+	}
+
+	// The other upstream lost the race, its attempt running out afterwards is not a failure
+	time.Sleep(300 * time.Millisecond)
+	if asked := counts(loser, fast); !slices.Equal(asked, []int{1, 1}) {
+		t.Errorf("Expected every upstream asked at once, got %v", asked)
+	}
+	f.health.mu.Lock()
+	stats := f.health.get(loser.addr, time.Now())
+	f.health.mu.Unlock()
+	if stats != nil && stats.failures > 0 {
+		t.Errorf("Expected a lost race not to count as a failure, got %d", stats.failures)
+	}
+
+	// A failing upstream does not win the race even when it answers first
+	broken := failing(t)
+	f, err = newForwarder(addrs(broken, answering(t, 3, 50*time.Millisecond)), StrategyParallel, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := forward(t, f); got != 3 {
+		t.Errorf("Expected the first good answer, got 192.0.2.%d", got)
+	}
+}
+
+func Test_ForwarderHealthReordering(t *testing.T) {
+	for _, strategy := range []Strategy{StrategySequential, StrategyRoundRobin} {
+		dead, alive := silent(t), answering(t, 2, 0)
+		f, err := newForwarder(addrs(dead, alive), strategy, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Round robin starts on the second upstream every other query, put the dead one first each time
+		for i := 0; i < failuresToDown; i++ {
+			if strategy == StrategyRoundRobin {
+				f.next.Store(0)
+			}
+			forward(t, f)
+		}
+		if dead.queries() != failuresToDown {
+			t.Fatalf("%s: expected the dead upstream tried %d times, got %d", strategy, failuresToDown, dead.queries())
+		}
+
+		// Down now, the healthy upstream goes first and the dead one is not asked again
+		if strategy == StrategyRoundRobin {
+			f.next.Store(0)
+		}
+		if order := f.order(); order[0] != alive.addr {
+			t.Errorf("%s: expected the healthy upstream first, got %v", strategy, order)
+		}
+		if got := forward(t, f); got != 2 || dead.queries() != failuresToDown {
+			t.Errorf("%s: expected the healthy upstream to answer alone, got 192.0.2.%d after %d queries to the dead one", strategy, got, dead.queries())
+		}
+	}
+	// Racing, a dead upstream always loses to a live one. Once down it is left out of the race.
+	dead, alive := silent(t), answering(t, 2, 0)
+	f, err := newForwarder(addrs(dead, alive), StrategyParallel, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < failuresToDown; i++ {
+		f.health.failure(dead.addr)
+	}
+	if got := forward(t, f); got != 2 || dead.queries() != 0 {
+		t.Errorf("parallel: expected the down upstream left out, got 192.0.2.%d after %d queries to it", got, dead.queries())
+	}
+}
@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	initialTimeout = 1 * time.Second        // for servers we have never talked to
+	minTimeout     = 100 * time.Millisecond // floor for fast servers, leaves room for jitter
+	maxTimeout     = 4 * time.Second
+	failuresToDown = 3                // consecutive timeouts before a server is skipped
+	minBackoff     = 5 * time.Second  // first time a server is skipped
+	maxBackoff     = 15 * time.Minute // longest a server is skipped
+	infraTTL       = 15 * time.Minute // stats older than this are forgotten
+)
+
+// serverStats is what we know about one upstream nameserver address.
+type serverStats struct {
+	srtt      time.Duration // smoothed round trip time, RFC 6298 style
+	failures  int           // consecutive failures
+	downUntil time.Time     // skipped until then unless every server is down
+	updated   time.Time
+}
+
+// infraCache tracks nameserver health so the resolver asks the fastest healthy server first.
+type infraCache struct {
+	mu      sync.Mutex
+	servers map[string]*serverStats
+}
+
+func newInfraCache() *infraCache {
+	return &infraCache{servers: make(map[string]*serverStats)}
+}
+
+// Current stats for addr, nil when unknown or stale. Caller holds mu.
+func (c *infraCache) get(addr string, now time.Time) *serverStats {
+	stats, ok := c.servers[addr]
+	if !ok {
+		return nil
+	}
+	if now.Sub(stats.updated) > infraTTL {
+		delete(c.servers, addr)
+		return nil
+	}
+	return stats
+}
+
+// Order addrs for querying: healthy servers by smoothed RTT, servers in backoff last.
+// Unknown servers get a random RTT below the initial timeout so they are explored too.
+func (c *infraCache) order(addrs []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	type candidate struct {
+		addr string
+		rtt  time.Duration
+		down bool
+	}
+
+	candidates := make([]candidate, 0, len(addrs))
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		cand := candidate{addr: addr, rtt: time.Duration(rand.Int63n(int64(initialTimeout / 4)))}
+		if stats := c.get(addr, now); stats != nil {
+			cand.rtt = stats.srtt
+			cand.down = now.Before(stats.downUntil)
+		}
+		candidates = append(candidates, cand)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].down != candidates[j].down {
+			return !candidates[i].down
+		}
+		return candidates[i].rtt < candidates[j].rtt
+	})
+
+	ordered := make([]string, len(candidates))
+	for i, cand := range candidates {
+		ordered[i] = cand.addr
+	}
+	return ordered
+}
+
+// How long to wait for addr: a few times its smoothed RTT, doubled for every
+// consecutive failure (exponential backoff).
+func (c *infraCache) timeout(addr string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.get(addr, time.Now())
+	if stats == nil {
+		return initialTimeout
+	}
+
+	timeout := 4 * stats.srtt
+	if stats.srtt == 0 {
+		timeout = initialTimeout
+	}
+	for i := 0; i < stats.failures && timeout < maxTimeout; i++ {
+		timeout *= 2
+	}
+	return min(max(timeout, minTimeout), maxTimeout)
+}
+
+func (c *infraCache) success(addr string, rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	stats := c.get(addr, now)
+	if stats == nil {
+		stats = &serverStats{srtt: rtt}
+		c.servers[addr] = stats
+	}
+
+	stats.srtt = (7*stats.srtt + 3*rtt) / 10
+	stats.failures = 0
+	stats.downUntil = time.Time{}
+	stats.updated = now
+}
+
+func (c *infraCache) failure(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	stats := c.get(addr, now)
+	if stats == nil {
+		stats = &serverStats{}
+		c.servers[addr] = stats
+	}
+
+	stats.failures++
+	stats.updated = now
+	// Penalize the RTT so a flapping server sorts behind its peers
+	stats.srtt = min(max(2*stats.srtt, initialTimeout), maxTimeout)
+
+	if stats.failures >= failuresToDown {
+		backoff := minBackoff
+		for i := failuresToDown; i < stats.failures && backoff < maxBackoff; i++ {
+			backoff *= 2
+		}
+		stats.downUntil = now.Add(min(backoff, maxBackoff))
+	}
+}
+
+// Keep the given order but move servers in backoff behind the healthy ones.
+func (c *infraCache) healthyFirst(addrs []string) []string {
+	healthy := c.healthy(addrs)
+	if len(healthy) == len(addrs) {
+		return addrs
+	}
+
+	ordered := append([]string{}, healthy...)
+	for _, addr := range addrs {
+		if c.down(addr) {
+			ordered = append(ordered, addr)
+		}
+	}
+	return ordered
+}
+
+// Servers not in backoff, all of them if every one is down.
+func (c *infraCache) healthy(addrs []string) []string {
+	var healthy []string
+	for _, addr := range addrs {
+		if !c.down(addr) {
+			healthy = append(healthy, addr)
+		}
+	}
+	if len(healthy) == 0 {
+		return addrs
+	}
+	return healthy
+}
+
+func (c *infraCache) down(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	stats := c.get(addr, now)
+	return stats != nil && now.Before(stats.downUntil)
+}
@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_InfraOrder(t *testing.T) {
+	c := newInfraCache()
+	c.success("slow", 300*time.Millisecond)
+	c.success("fast", 20*time.Millisecond)
+	for i := 0; i < failuresToDown; i++ {
+		c.failure("down")
+	}
+
+	got := c.order([]string{"down", "slow", "fast", "fast"})
+	if !slices.Equal(got, []string{"fast", "slow", "down"}) {
+		t.Errorf("Expected fastest first, duplicates dropped and the down server last, got %v", got)
+	}
+
+	// An unknown server is explored before a known slow one
+	got = c.order([]string{"slow", "new"})
+	if got[0] != "new" {
+		t.Errorf("Expected the unknown server first, got %v", got)
+	}
+}
+
+func Test_InfraTimeout(t *testing.T) {
+	c := newInfraCache()
+	if got := c.timeout("new"); got != initialTimeout {
+		t.Errorf("Expected %s for an unknown server, got %s", initialTimeout, got)
+	}
+
+	c.success("fast", time.Millisecond)
+	if got := c.timeout("fast"); got != minTimeout {
+		t.Errorf("Expected the %s floor for a fast server, got %s", minTimeout, got)
+	}
+
+	c.success("lan", 100*time.Millisecond)
+	if got := c.timeout("lan"); got != 400*time.Millisecond {
+		t.Errorf("Expected four times the smoothed RTT, got %s", got)
+	}
+
+	// A failure doubles the RTT estimate and then the timeout, up to the cap
+	c.failure("lan")
+	if got := c.timeout("lan"); got != maxTimeout {
+		t.Errorf("Expected the %s cap after a failure, got %s", maxTimeout, got)
+	}
+}
+
+func Test_InfraBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		down     bool
+		backoff  time.Duration
+	}{
+		{failures: failuresToDown - 1, down: false},
+		{failures: failuresToDown, down: true, backoff: minBackoff},
+		{failures: failuresToDown + 1, down: true, backoff: 2 * minBackoff},
+		{failures: failuresToDown + 2, down: true, backoff: 4 * minBackoff},
+		{failures: failuresToDown + 20, down: true, backoff: maxBackoff},
+	}
+
+	for _, tt := range tests {
+		c := newInfraCache()
+		start := time.Now()
+		for i := 0; i < tt.failures; i++ {
+			c.failure("server")
+		}
+
+		if got := c.down("server"); got != tt.down {
+			t.Errorf("Expected down=%v after %d failures, got %v", tt.down, tt.failures, got)
+			continue
+		}
+		if !tt.down {
+			continue
+		}
+		backoff := c.servers["server"].downUntil.Sub(start)
+		if backoff < tt.backoff || backoff > tt.backoff+time.Second {
+			t.Errorf("Expected a backoff of %s after %d failures, got %s", tt.backoff, tt.failures, backoff)
+		}
+
+		c.success("server", 10*time.Millisecond)
+		if c.down("server") || c.servers["server"].failures != 0 {
+			t.Errorf("Expected a success to end the backoff after %d failures", tt.failures)
+		}
+	}
+}
+
+func Test_InfraHealthy(t *testing.T) {
+	c := newInfraCache()
+	for i := 0; i < failuresToDown; i++ {
+		c.failure("b")
+	}
+
+	if got := c.healthy([]string{"a", "b", "c"}); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("Expected the servers in backoff left out, got %v", got)
+	}
+	if got := c.healthy([]string{"b"}); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("Expected every server when all are down, got %v", got)
+	}
+	if got := c.healthyFirst([]string{"b", "a", "c"}); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("Expected the configured order with the down server last, got %v", got)
+	}
+}
+
+func Test_InfraStatsExpire(t *testing.T) {
+	c := newInfraCache()
+	for i := 0; i < failuresToDown; i++ {
+		c.failure("server")
+	}
+	c.servers["server"].updated = time.Now().Add(-infraTTL - time.Second)
+
+	if c.down("server") {
+		t.Error("Expected stale stats to be forgotten")
+	}
+	if _, ok := c.servers["server"]; ok {
+		t.Error("Expected stale stats to be removed")
+	}
+}
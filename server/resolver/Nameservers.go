@@ -0,0 +1,55 @@
+package resolver
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+)
+
+// Nameservers returns the NS records of the closest zone holding name, below the root,
+// followed by the addresses of those servers. They are looked up like any question, so
+// the answer is the same whether it comes from the cache, the root down or a forwarder.
+func (r *Resolver) Nameservers(name dnsmessage.Name, id uint16) ([]entities.Record, error) {
+	for zone := strings.ToLower(name.String()); zone != "."; {
+		zoneName, err := dnsmessage.NewName(zone)
+		if err != nil {
+			return nil, err
+		}
+		result, err := r.ResolveDN(zoneName, id, dnsmessage.TypeNS)
+		if err != nil {
+			return nil, err
+		}
+
+		// A CNAME at the name leads to the NS of another zone, not of this one
+		var records []entities.Record
+		for _, record := range result.Answers {
+			if record.RType == dnsmessage.TypeNS && strings.EqualFold(record.Name.String(), zone) {
+				records = append(records, record)
+			}
+		}
+		if len(records) == 0 {
+			_, rest, _ := strings.Cut(zone, ".")
+			zone = entities.FQDN(rest)
+			continue
+		}
+
+		// The range is over the NS records only, addresses are appended behind them
+		for _, record := range records {
+			target := record.Body.(*dnsmessage.NSResource).NS
+			for _, rtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+				// A server without addresses still counts by name
+				addrs, err := r.ResolveDN(target, id, rtype)
+				if err != nil {
+					continue
+				}
+				for _, addr := range addrs.Answers {
+					if addr.IP() != nil {
+						records = append(records, addr)
+					}
+				}
+			}
+		}
+		return records, nil
+	}
+	return nil, nil
+}
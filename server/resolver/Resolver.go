@@ -1,143 +1,117 @@
 package resolver
 
 import (
+	"context"
 	"dnsthingymagik/server/recordcache"
 	"dnsthingymagik/server/resolver/entities"
 	"dnsthingymagik/server/resolver/query"
+	"errors"
+	"fmt"
 	"golang.org/x/net/dns/dnsmessage"
 	"log"
-	"net"
+	"strings"
+	"time"
 )
 
-func ResolveDN(domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type, cache *recordcache.Cache) ([]entities.Record, error) {
-	if recs, found := cache.Get(domainName, rtype); found {
-		return recs, nil
-	}
+const queryBudget = 10 * time.Second // total time spent on one question, all retries included
 
-	ROOT_SERVERS := []string{
-		"198.41.0.4",
-	}
+var (
+	ErrNoNameserver   = errors.New("no nameserver answered")
+	ErrUpwardReferral = errors.New("referral does not lead closer to the name")
+)
 
-	result, err := resolveFromRoot(domainName, id, rtype, ROOT_SERVERS, cache)
-	if err != nil {
-		return nil, err
-	}
+// Resolver iterates from the root servers, or asks upstream resolvers when
+// forwarding, and keeps answers in cache.
+type Resolver struct {
+	cache     *recordcache.Cache
+	roots     *rootHints
+	infra     *infraCache
+	flights   *flightGroup
+	forwarder *forwarder // nil when iterating from the root
+	// Zones answered by their own servers, checked before the cache and the usual path
+	conditional []*conditionalRule
+}
 
-	for _, rec := range result {
-		cache.Set(rec)
+func NewResolver(cache *recordcache.Cache) *Resolver {
+	return &Resolver{
+		cache:   cache,
+		roots:   newRootHints(),
+		infra:   newInfraCache(),
+		flights: newFlightGroup(),
 	}
-
-	return result, nil
 }
 
-func resolveFromRoot(domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type, ROOT_SERVERS []string, cache *recordcache.Cache) ([]entities.Record, error) {
-	var records []entities.Record
-
-	for _, rootServer := range ROOT_SERVERS {
-
-		q := dnsmessage.Message{
-			Header: dnsmessage.Header{
-				ID:               id,
-				RecursionDesired: true, // Ensure we don't depend on external recursion
-			},
-			Questions: []dnsmessage.Question{
-				{
-					Name:  domainName,
-					Type:  rtype,
-					Class: dnsmessage.ClassINET,
-				},
-			},
-		}
-		response, err := query.SendQuery(rootServer, q)
-		if err != nil {
-			return nil, err
-		}
+// ResolveDN answers a client question. Concurrent calls for the same question share
+// one resolution; the lookups the resolver makes for itself (nameserver addresses) are
+// not coalesced, so a resolution can never end up waiting for itself.
+func (r *Resolver) ResolveDN(domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type) (entities.Result, error) {
+	// Only class IN is iterated, the class is part of the key so others never share its answer
+	key := flightKey(domainName, rtype, dnsmessage.ClassINET)
+	return r.flights.do(key, func() (entities.Result, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), queryBudget)
+		defer cancel()
 
-		NSIPmap := make(map[string]net.IP)
-		var NSs []string
-
-		for _, answer := range response.Answers {
-			if answer.Header.Type == dnsmessage.TypeA && response.Header.Authoritative {
-				NSs = append(NSs, answer.Header.Name.String())
-				r := entities.Record{
-					IP:    answer.Body.(*dnsmessage.AResource).A[:],
-					RType: answer.Header.Type,
-					TTL:   answer.Header.TTL,
-					Class: answer.Header.Class,
-					Name:  answer.Header.Name,
-				}
-				records = append(records, r)
-			} else if answer.Header.Type == dnsmessage.TypeAAAA && response.Header.Authoritative {
-				NSs = append(NSs, answer.Header.Name.String())
-				r := entities.Record{
-					IP:    answer.Body.(*dnsmessage.AAAAResource).AAAA[:],
-					RType: answer.Header.Type,
-					TTL:   answer.Header.TTL,
-					Class: answer.Header.Class,
-					Name:  answer.Header.Name,
-				}
-				records = append(records, r)
-			} else if answer.Header.Type == dnsmessage.TypeNS {
-				NSs = append(NSs, answer.Header.Name.String())
-			} else if answer.Header.Type == dnsmessage.TypeCNAME {
-				cname := answer.Body.(*dnsmessage.CNAMEResource).CNAME
-				// Recursively resolve the CNAME target
-				cnameRecords, err := ResolveDN(cname, id, rtype, cache)
-				if err != nil {
-					log.Printf("Failed to resolve CNAME target %s: %v", cname.String(), err)
-					continue
-				}
-				records = append(records, cnameRecords...)
-			}
-		}
+		return r.resolveChain(ctx, domainName, id, rtype, nil)
+	})
+}
 
-		for _, authority := range response.Authorities {
-			if authority.Header.Type == dnsmessage.TypeNS {
-				NSs = append(NSs, authority.Header.Name.String())
-			}
-		}
+// Resolve the records owned by domainName itself, either the requested RRset or a CNAME.
+func (r *Resolver) lookup(ctx context.Context, domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type) (entities.Result, error) {
+	cache, upstream := r.cache, r.forwarder
+	if rule := r.conditionalRuleFor(domainName); rule != nil {
+		cache, upstream = rule.cache, rule.forwarder
+	}
 
-		for _, additional := range response.Additionals {
-			if additional.Header.Type == dnsmessage.TypeA {
-				ip := additional.Body.(*dnsmessage.AResource).A[:]
-				if ip != nil {
-					NSIPmap[additional.Header.Name.String()] = ip
-				}
-			}
+	if result, found := cache.Get(domainName, rtype); found {
+		return result, nil
+	}
+	if rtype != dnsmessage.TypeCNAME {
+		if result, found := cache.Get(domainName, dnsmessage.TypeCNAME); found && !result.NoData() {
+			return result, nil
 		}
+	}
 
-		if len(records) > 0 && response.Header.Authoritative {
-			return records, nil
-		}
+	var result entities.Result
+	var err error
+	if upstream != nil {
+		result, err = upstream.resolve(ctx, domainName, id, rtype)
+	} else {
+		result, err = r.resolveFromRoot(ctx, domainName, id, rtype)
+	}
+	if err != nil {
+		return entities.Result{}, err
+	}
 
-		//resolve from refferal
-		for nameserver, nsip := range NSIPmap {
-			if nsip == nil {
-				nsips, err := ResolveDN(dnsmessage.MustNewName(nameserver), id, dnsmessage.TypeA, cache) // resolve nameserver if no ip
-				nsip = nsips[0].IP
-				if err != nil || len(nsip) == 0 {
-					log.Printf("DNS server %s not resolved: %s", nameserver, err)
-					continue
-				}
-
-				NSIPmap[nameserver] = nsip
-			}
+	// Every RRset of the chain is cached on its own, the targets are picked up from there
+	for _, rec := range result.Answers {
+		cache.Set(rec)
+	}
 
-			ip, err := resolveFromRefferal(domainName, id, rtype, nsip.String(), cache) // resolve refferal using nameserver
-			if err != nil {
-				log.Printf("DNS server %s not resolving domain %s: %s", nameserver, domainName, err)
-				continue
-			}
+	// A negative answer belongs to the end of the chain, the aliases on the way do exist
+	end, found := domainName, true
+	if rtype != dnsmessage.TypeCNAME {
+		end, found = chainEnd(result.Answers, domainName)
+	}
+	negative := result.RCode == dnsmessage.RCodeNameError || (result.RCode == dnsmessage.RCodeSuccess && !answersQuestion(result.Answers, rtype))
+	if negative && found {
+		cache.SetNegative(end, rtype, result)
+	}
 
-			records = append(records, ip...)
-			break
-		}
+	// Only the records of domainName are returned when a chain was followed, the targets come from the cache
+	answers := ownedBy(result.Answers, domainName)
+	if !found || !sameName(end, domainName) || len(answers) < len(result.Answers) {
+		return entities.Result{Answers: answers}, nil
 	}
 
-	return records, nil
+	return result, nil
 }
 
-func resolveFromRefferal(domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type, server string, cache *recordcache.Cache) ([]entities.Record, error) {
+func (r *Resolver) resolveFromRoot(ctx context.Context, domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type) (entities.Result, error) {
+	return r.resolveFromRefferal(ctx, domainName, id, rtype, dnsmessage.MustNewName("."), r.roots.servers())
+}
+
+// Ask the nameservers of zone about domainName and follow referrals down to the answer.
+func (r *Resolver) resolveFromRefferal(ctx context.Context, domainName dnsmessage.Name, id uint16, rtype dnsmessage.Type, zone dnsmessage.Name, servers []string) (entities.Result, error) {
 	q := dnsmessage.Message{
 		Header: dnsmessage.Header{
 			ID:               id,
@@ -151,84 +125,163 @@ func resolveFromRefferal(domainName dnsmessage.Name, id uint16, rtype dnsmessage
 			},
 		},
 	}
-	response, err := query.SendQuery(server, q)
+	response, err := r.exchange(ctx, servers, q, zone)
 	if err != nil {
-		return nil, err
+		return entities.Result{}, err
 	}
 
-	var records []entities.Record
-	NSIPmap := make(map[string]net.IP)
-
-	for _, answer := range response.Answers {
-		if answer.Header.Type == dnsmessage.TypeA && response.Header.Authoritative {
-			r := entities.Record{
-				IP:    answer.Body.(*dnsmessage.AResource).A[:],
-				RType: answer.Header.Type,
-				TTL:   answer.Header.TTL,
-				Class: answer.Header.Class,
-				Name:  answer.Header.Name,
-			}
-			records = append(records, r)
-		} else if answer.Header.Type == dnsmessage.TypeAAAA && response.Header.Authoritative {
-			r := entities.Record{
-				IP:    answer.Body.(*dnsmessage.AAAAResource).AAAA[:],
-				RType: answer.Header.Type,
-				TTL:   answer.Header.TTL,
-				Class: answer.Header.Class,
-				Name:  answer.Header.Name,
-			}
-			records = append(records, r)
-		} else if answer.Header.Type == dnsmessage.TypeNS {
-			NSIPmap[answer.Body.(*dnsmessage.NSResource).NS.String()] = nil
-		} else if answer.Header.Type == dnsmessage.TypeCNAME {
-			cname := answer.Body.(*dnsmessage.CNAMEResource).CNAME
-			// Recursively resolve the CNAME target
-			cnameRecords, err := ResolveDN(cname, id, rtype, cache)
-			if err != nil {
-				log.Printf("Failed to resolve CNAME target %s: %v", cname.String(), err)
-				continue
-			}
-			records = append(records, cnameRecords...)
-		}
+	if result, final, err := finalAnswer(response, domainName, rtype); err != nil || final {
+		return result, err
 	}
 
+	// Referral: NS records of a zone cut below the current zone, with glue addresses
+	var cut dnsmessage.Name
+	var nameservers []dnsmessage.Name
 	for _, authority := range response.Authorities {
 		if authority.Header.Type == dnsmessage.TypeNS {
-			NSIPmap[authority.Body.(*dnsmessage.NSResource).NS.String()] = nil
+			cut = authority.Header.Name
+			nameservers = append(nameservers, authority.Body.(*dnsmessage.NSResource).NS)
 		}
 	}
+	if len(nameservers) == 0 {
+		return entities.Result{}, fmt.Errorf("no referral for %s from zone %s", domainName, zone)
+	}
+	if !isSubdomain(domainName, cut) || !isSubdomain(cut, zone) || sameName(cut, zone) {
+		return entities.Result{}, fmt.Errorf("%w: %s from zone %s", ErrUpwardReferral, cut, zone)
+	}
 
+	var glue []string
 	for _, additional := range response.Additionals {
-		if additional.Header.Type == dnsmessage.TypeA {
-			NSIPmap[additional.Header.Name.String()] = additional.Body.(*dnsmessage.AResource).A[:]
+		ip := entities.NewRecord(additional).IP()
+		if ip != nil && isNameserver(additional.Header.Name, nameservers) {
+			glue = append(glue, ip.String())
 		}
 	}
-
-	if len(records) > 0 && response.Header.Authoritative {
-		return records, nil
+	if len(glue) > 0 {
+		return r.resolveFromRefferal(ctx, domainName, id, rtype, cut, glue)
 	}
 
-	for nameserver, nsip := range NSIPmap {
-		if nsip == nil {
-			nsips, err := ResolveDN(dnsmessage.MustNewName(nameserver), id, dnsmessage.TypeA, cache) // resolve nameserver if no ip
-			nsip = nsips[0].IP
-			if err != nil || len(nsip) == 0 {
-				log.Printf("DNS server %s not resolved: %s", nameserver, err)
-				continue
-			}
+	// No glue, resolve the nameserver names one at a time until one of them leads to the answer
+	lastErr := ErrNoNameserver
+	for _, nameserver := range nameservers {
+		if isSubdomain(nameserver, cut) {
+			// Without glue an in-zone nameserver cannot be reached
+			continue
+		}
 
-			NSIPmap[nameserver] = nsip
+		nsips, err := r.resolveChain(ctx, nameserver, id, dnsmessage.TypeA, nil) // resolve nameserver if no ip
+		nsip := firstIP(nsips.Answers)
+		if err != nil || nsip == nil {
+			log.Printf("DNS server %s not resolved: %v", nameserver, err)
+			continue
 		}
 
-		ip, err := resolveFromRefferal(domainName, id, rtype, nsip.String(), cache) // resolve refferal using nameserver
+		result, err := r.resolveFromRefferal(ctx, domainName, id, rtype, cut, []string{nsip.String()}) // resolve refferal using nameserver
 		if err != nil {
 			log.Printf("DNS server %s not resolving domain %s: %s", nameserver, domainName, err)
+			lastErr = err
+			continue
+		}
+
+		return result, nil
+	}
+
+	return entities.Result{}, lastErr
+}
+
+// Send q to the servers of zone, fastest healthy server first. Each attempt waits according to the
+// server's smoothed RTT; on a timeout or a useless answer the query is retransmitted to the next one.
+func (r *Resolver) exchange(ctx context.Context, servers []string, q dnsmessage.Message, zone dnsmessage.Name) (dnsmessage.Message, error) {
+	var lastErr error = ErrNoNameserver
+	for _, server := range r.infra.order(servers) {
+		if ctx.Err() != nil {
+			return dnsmessage.Message{}, fmt.Errorf("query budget exhausted: %w", lastErr)
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, r.infra.timeout(server))
+		start := time.Now()
+		response, err := query.SendQuery(attemptCtx, server, q)
+		cancel()
+		if err != nil {
+			r.infra.failure(server)
+			lastErr = err
 			continue
 		}
 
-		records = append(records, ip...)
-		break
+		switch {
+		case lame(response, q.Questions[0].Name, zone):
+			// Delegated but not serving the zone, as useless as a SERVFAIL
+			r.infra.failure(server)
+			lastErr = fmt.Errorf("%s is lame for zone %s", server, zone)
+		case response.Header.RCode == dnsmessage.RCodeSuccess, response.Header.RCode == dnsmessage.RCodeNameError:
+			r.infra.success(server, time.Since(start))
+			return response, nil
+		default:
+			// SERVFAIL, REFUSED and friends mean this server is of no use, try another one
+			r.infra.failure(server)
+			lastErr = fmt.Errorf("%s answered %s", server, response.Header.RCode)
+		}
 	}
 
-	return records, nil
+	return dnsmessage.Message{}, lastErr
+}
+
+// A lame server answers for a zone it does not serve: a NOERROR that is neither
+// authoritative nor a referral further down towards domainName.
+func lame(response dnsmessage.Message, domainName, zone dnsmessage.Name) bool {
+	if response.Header.RCode != dnsmessage.RCodeSuccess || response.Header.Authoritative {
+		return false
+	}
+	for _, authority := range response.Authorities {
+		cut := authority.Header.Name
+		if authority.Header.Type == dnsmessage.TypeNS && isSubdomain(domainName, cut) && isSubdomain(cut, zone) && !sameName(cut, zone) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decide whether a response ends the resolution. Authoritative answers, positive or
+// NODATA, and NXDOMAIN are final; a NOERROR without authority is a referral to follow.
+func finalAnswer(response dnsmessage.Message, domainName dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, bool, error) {
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		if !response.Header.Authoritative {
+			return entities.Result{}, false, nil
+		}
+	case dnsmessage.RCodeNameError:
+	default:
+		return entities.Result{}, false, fmt.Errorf("upstream answered %s", response.Header.RCode)
+	}
+
+	result := entities.Result{
+		RCode:   response.Header.RCode,
+		Answers: chainAnswers(response.Answers, domainName, rtype),
+	}
+
+	if result.RCode == dnsmessage.RCodeNameError || !answersQuestion(result.Answers, rtype) {
+		for _, authority := range response.Authorities {
+			if authority.Header.Type == dnsmessage.TypeSOA {
+				result.Authority = append(result.Authority, entities.NewRecord(authority))
+			}
+		}
+	}
+
+	return result, true, nil
+}
+
+// Whether name equals zone or lies below it.
+func isSubdomain(name, zone dnsmessage.Name) bool {
+	n := strings.ToLower(name.String())
+	z := strings.ToLower(zone.String())
+	return z == "." || n == z || strings.HasSuffix(n, "."+z)
+}
+
+func isNameserver(name dnsmessage.Name, nameservers []dnsmessage.Name) bool {
+	for _, nameserver := range nameservers {
+		if sameName(name, nameserver) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,283 @@
+package resolver
+
+import (
+	"context"
+	"dnsthingymagik/server/recordcache"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A nameserver on a loopback UDP port. handle builds the reply to a question, nil sends
+// nothing; the reply gets the query's ID and question.
+type stubServer struct {
+	addr   string
+	handle func(q dnsmessage.Question) *dnsmessage.Message
+
+	mu    sync.Mutex
+	asked int
+}
+
+func newStubServer(t *testing.T, handle func(q dnsmessage.Question) *dnsmessage.Message) *stubServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveStub(t, pc, handle)
+}
+
+func serveStub(t *testing.T, pc net.PacketConn, handle func(q dnsmessage.Question) *dnsmessage.Message) *stubServer {
+	t.Cleanup(func() { pc.Close() })
+	s := &stubServer{addr: pc.LocalAddr().String(), handle: handle}
+
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				var q dnsmessage.Message
+				if q.Unpack(buf[:n]) != nil || len(q.Questions) != 1 {
+					return
+				}
+				s.mu.Lock()
+				s.asked++
+				s.mu.Unlock()
+
+				reply := s.handle(q.Questions[0])
+				if reply == nil {
+					return
+				}
+				reply.Header.ID = q.Header.ID
+				reply.Header.Response = true
+				reply.Questions = q.Questions
+				if packed, err := reply.Pack(); err == nil {
+					pc.WriteTo(packed, from)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// Number of questions the stub has received.
+func (s *stubServer) queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.asked
+}
+
+func soaResource(zone string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns." + zone), MBox: dnsmessage.MustNewName("hostmaster." + zone), MinTTL: 60},
+	}
+}
+
+func Test_FinalAnswer(t *testing.T) {
+	a := dnsmessage.TypeA
+	question := dnsmessage.MustNewName("www.test.")
+	referral := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.test.")},
+	}
+
+	tests := []struct {
+		name      string
+		response  dnsmessage.Message
+		final     bool
+		err       bool
+		rcode     dnsmessage.RCode
+		answers   string
+		authority string
+	}{
+		{
+			name: "positive answer has no authority",
+			response: dnsmessage.Message{
+				Header:      dnsmessage.Header{Authoritative: true},
+				Answers:     []dnsmessage.Resource{aResource("www.test.", 1)},
+				Authorities: []dnsmessage.Resource{soaResource("test.")},
+			},
+			final:   true,
+			answers: "www.test. A",
+		},
+		{
+			name: "NXDOMAIN keeps the SOA",
+			response: dnsmessage.Message{
+				Header:      dnsmessage.Header{Authoritative: true, RCode: dnsmessage.RCodeNameError},
+				Authorities: []dnsmessage.Resource{referral, soaResource("test.")},
+			},
+			final:     true,
+			rcode:     dnsmessage.RCodeNameError,
+			authority: "test. SOA",
+		},
+		{
+			name: "NODATA keeps the SOA",
+			response: dnsmessage.Message{
+				Header:      dnsmessage.Header{Authoritative: true},
+				Authorities: []dnsmessage.Resource{soaResource("test.")},
+			},
+			final:     true,
+			authority: "test. SOA",
+		},
+		{
+			name: "CNAME to a missing name keeps the target zone's SOA",
+			response: dnsmessage.Message{
+				Header:      dnsmessage.Header{Authoritative: true, RCode: dnsmessage.RCodeNameError},
+				Answers:     []dnsmessage.Resource{cnameResource("www.test.", "gone.other.")},
+				Authorities: []dnsmessage.Resource{soaResource("other.")},
+			},
+			final:     true,
+			rcode:     dnsmessage.RCodeNameError,
+			answers:   "www.test. CNAME",
+			authority: "other. SOA",
+		},
+		{
+			name: "CNAME to NODATA keeps the SOA",
+			response: dnsmessage.Message{
+				Header:      dnsmessage.Header{Authoritative: true},
+				Answers:     []dnsmessage.Resource{cnameResource("www.test.", "cdn.test.")},
+				Authorities: []dnsmessage.Resource{soaResource("test.")},
+			},
+			final:     true,
+			answers:   "www.test. CNAME",
+			authority: "test. SOA",
+		},
+		{
+			name: "referral is not final",
+			response: dnsmessage.Message{
+				Authorities: []dnsmessage.Resource{referral},
+			},
+		},
+		{
+			name:     "SERVFAIL is an error",
+			response: dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}},
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		result, final, err := finalAnswer(tt.response, question, a)
+		if (err != nil) != tt.err || final != tt.final {
+			t.Errorf("%s: expected final=%v err=%v, got final=%v err=%v", tt.name, tt.final, tt.err, final, err)
+			continue
+		}
+		if !final {
+			continue
+		}
+		if result.RCode != tt.rcode || describe(result.Answers) != tt.answers || describe(result.Authority) != tt.authority {
+			t.Errorf("%s: expected %s [%s] [%s], got %s [%s] [%s]", tt.name, tt.rcode, tt.answers, tt.authority,
+				result.RCode, describe(result.Answers), describe(result.Authority))
+		}
+	}
+}
+
+func Test_NegativeAnswerAtChainEnd(t *testing.T) {
+	alias := dnsmessage.MustNewName("alias.test.")
+	target := dnsmessage.MustNewName("target.test.")
+	a := dnsmessage.TypeA
+
+	for _, rcode := range []dnsmessage.RCode{dnsmessage.RCodeNameError, dnsmessage.RCodeSuccess} {
+		// Only the alias and the negative answer for its target, no records of the target itself
+		upstream := newStubServer(t, func(q dnsmessage.Question) *dnsmessage.Message {
+			reply := &dnsmessage.Message{
+				Header:      dnsmessage.Header{RecursionAvailable: true, RCode: rcode},
+				Authorities: []dnsmessage.Resource{soaResource("test.")},
+			}
+			if sameName(q.Name, alias) {
+				reply.Answers = []dnsmessage.Resource{cnameResource("alias.test.", "target.test.")}
+			}
+			return reply
+		})
+		cache := recordcache.NewCache()
+		t.Cleanup(cache.Close)
+		r, err := NewForwardingResolver(cache, []string{upstream.addr}, StrategySequential, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			result, err := r.ResolveDN(alias, 1, a)
+			if err != nil {
+				t.Fatalf("%s: %v", rcode, err)
+			}
+			if result.RCode != rcode || describe(result.Answers) != "alias.test. CNAME" || describe(result.Authority) != "test. SOA" {
+				t.Errorf("%s, query %d: expected the alias and the negative answer, got %s [%s] [%s]", rcode, i+1,
+					result.RCode, describe(result.Answers), describe(result.Authority))
+			}
+		}
+		if upstream.queries() != 1 {
+			t.Errorf("%s: expected the repeat to come from the cache, upstream asked %d times", rcode, upstream.queries())
+		}
+
+		if cached, found := cache.Get(target, a); !found || cached.RCode != rcode || len(cached.Answers) != 0 {
+			t.Errorf("%s: expected the negative answer cached under the target, got %v %+v", rcode, found, cached)
+		}
+		if cached, found := cache.Get(alias, a); found {
+			t.Errorf("%s: expected nothing negative cached under the alias, got %s %+v", rcode, cached.RCode, cached)
+		}
+		result, err := r.ResolveDN(alias, 1, dnsmessage.TypeCNAME)
+		if err != nil || describe(result.Answers) != "alias.test. CNAME" {
+			t.Errorf("%s: expected the alias to still have its CNAME, got %s (%v)", rcode, describe(result.Answers), err)
+		}
+	}
+}
+
+func Test_LameDelegation(t *testing.T) {
+	nsResource := func(owner string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(owner), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns.elsewhere.")},
+		}
+	}
+	tests := []struct {
+		name  string
+		reply dnsmessage.Message
+	}{
+		{name: "empty non-authoritative NOERROR", reply: dnsmessage.Message{}},
+		{name: "upward referral", reply: dnsmessage.Message{Authorities: []dnsmessage.Resource{nsResource(".")}}},
+		{name: "referral to the zone asked", reply: dnsmessage.Message{Authorities: []dnsmessage.Resource{nsResource("test.")}}},
+		{name: "referral off to another branch", reply: dnsmessage.Message{Authorities: []dnsmessage.Resource{nsResource("other.test.")}}},
+	}
+
+	for _, tt := range tests {
+		lameServer := newStubServer(t, func(dnsmessage.Question) *dnsmessage.Message {
+			reply := tt.reply
+			return &reply
+		})
+		good := newStubServer(t, func(q dnsmessage.Question) *dnsmessage.Message {
+			return &dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{aResource("www.test.", 1)},
+			}
+		})
+
+		cache := recordcache.NewCache()
+		t.Cleanup(cache.Close)
+		r := NewResolver(cache)
+		// The lame server looks fastest, so it is asked first
+		r.infra.success(lameServer.addr, time.Millisecond)
+		r.infra.success(good.addr, 500*time.Millisecond)
+
+		result, err := r.resolveFromRefferal(context.Background(), dnsmessage.MustNewName("www.test."), 1, dnsmessage.TypeA,
+			dnsmessage.MustNewName("test."), []string{lameServer.addr, good.addr})
+		if err != nil {
+			t.Errorf("%s: expected the next server to answer, got %v", tt.name, err)
+			continue
+		}
+		if describe(result.Answers) != "www.test. A" {
+			t.Errorf("%s: expected the good server's answer, got %s", tt.name, describe(result.Answers))
+		}
+		if lameServer.queries() != 1 || good.queries() != 1 {
+			t.Errorf("%s: expected one query to each server, got %d and %d", tt.name, lameServer.queries(), good.queries())
+		}
+		if order := r.infra.order([]string{lameServer.addr, good.addr}); order[0] != good.addr {
+			t.Errorf("%s: expected the lame server counted as a failure and moved back, got %v", tt.name, order)
+		}
+	}
+}
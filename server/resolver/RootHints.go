@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	primingRetry  = time.Minute // wait before priming again after a failure
+	minPrimingTTL = time.Hour   // never re-prime more often than this, whatever TTL the roots send
+)
+
+// Built-in copy of https://www.internic.net/domain/named.root
+var builtinRootHints = []struct {
+	name string
+	ipv4 string
+	ipv6 string
+}{
+	{"a.root-servers.net.", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net.", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net.", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net.", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net.", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net.", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net.", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net.", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net.", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net.", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net.", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net.", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net.", "202.12.27.33", "2001:dc3::35"},
+}
+
+// rootHints holds the addresses of the root servers, refreshed by priming.
+type rootHints struct {
+	mu    sync.RWMutex
+	addrs []net.IP
+}
+
+func newRootHints() *rootHints {
+	h := &rootHints{}
+	for _, root := range builtinRootHints {
+		h.addrs = append(h.addrs, net.ParseIP(root.ipv4), net.ParseIP(root.ipv6))
+	}
+	return h
+}
+
+// Root server addresses to try, IPv4 first and shuffled so unmeasured roots share the load.
+func (h *rootHints) servers() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var ipv4, ipv6 []string
+	for _, addr := range h.addrs {
+		if addr.To4() != nil {
+			ipv4 = append(ipv4, addr.String())
+		} else {
+			ipv6 = append(ipv6, addr.String())
+		}
+	}
+	rand.Shuffle(len(ipv4), func(i, j int) { ipv4[i], ipv4[j] = ipv4[j], ipv4[i] })
+	rand.Shuffle(len(ipv6), func(i, j int) { ipv6[i], ipv6[j] = ipv6[j], ipv6[i] })
+
+	return append(ipv4, ipv6...)
+}
+
+func (h *rootHints) set(addrs []net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs = addrs
+}
+
+// LoadRootHints replaces the built-in root servers with the addresses from a named.root style file.
+func (r *Resolver) LoadRootHints(path string) error {
+	records, err := parseRootHints(path)
+	if err != nil {
+		return err
+	}
+
+	addrs := rootAddresses(records)
+	if len(addrs) == 0 {
+		return fmt.Errorf("%s: no root server addresses", path)
+	}
+
+	r.roots.set(addrs)
+	return nil
+}
+
+// Parse the NS, A and AAAA records of a root hints file, other lines are ignored.
+// Lines have the master file form: owner [TTL] [class] type rdata.
+func parseRootHints(path string) ([]entities.Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []entities.Record
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		name, err := dnsmessage.NewName(entities.FQDN(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		record := entities.Record{Name: name, Class: dnsmessage.ClassINET, TTL: 3600000}
+
+		rest := fields[1:]
+		if ttl, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+			record.TTL = uint32(ttl)
+			rest = rest[1:]
+		}
+		if len(rest) > 0 && strings.EqualFold(rest[0], "IN") {
+			rest = rest[1:]
+		}
+		if len(rest) < 2 {
+			continue
+		}
+
+		switch strings.ToUpper(rest[0]) {
+		case "NS":
+			ns, err := dnsmessage.NewName(entities.FQDN(rest[1]))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			record.RType = dnsmessage.TypeNS
+			record.Body = &dnsmessage.NSResource{NS: ns}
+		case "A":
+			ip := net.ParseIP(rest[1]).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid IPv4 address %q", path, lineNo, rest[1])
+			}
+			record.RType = dnsmessage.TypeA
+			record.Body = &dnsmessage.AResource{A: [4]byte(ip)}
+		case "AAAA":
+			ip := net.ParseIP(rest[1])
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("%s:%d: invalid IPv6 address %q", path, lineNo, rest[1])
+			}
+			record.RType = dnsmessage.TypeAAAA
+			record.Body = &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}
+		default:
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Addresses of the servers named by the root NS records.
+func rootAddresses(records []entities.Record) []net.IP {
+	roots := make(map[string]bool)
+	for _, record := range records {
+		if ns, ok := record.Body.(*dnsmessage.NSResource); ok && record.Name.String() == "." {
+			roots[strings.ToLower(ns.NS.String())] = true
+		}
+	}
+
+	var addrs []net.IP
+	for _, record := range records {
+		if ip := record.IP(); ip != nil && roots[strings.ToLower(record.Name.String())] {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// Prime asks a root server for the current root NS set (RFC 8109), replaces the
+// hints with it and caches the records. It returns how long the set stays valid.
+func (r *Resolver) Prime() (time.Duration, error) {
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID: uint16(rand.Uint32()),
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName("."),
+				Type:  dnsmessage.TypeNS,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryBudget)
+	defer cancel()
+
+	response, err := r.exchange(ctx, r.roots.servers(), q, dnsmessage.MustNewName("."))
+	if err != nil {
+		return 0, fmt.Errorf("priming failed: %w", err)
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess || !response.Header.Authoritative {
+		return 0, fmt.Errorf("priming failed: root server answered %s", response.Header.RCode)
+	}
+
+	var records []entities.Record
+	ttl := uint32(0)
+	for _, resource := range append(response.Answers, response.Additionals...) {
+		switch resource.Header.Type {
+		case dnsmessage.TypeNS, dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			record := entities.NewRecord(resource)
+			records = append(records, record)
+			if record.RType == dnsmessage.TypeNS && (ttl == 0 || record.TTL < ttl) {
+				ttl = record.TTL
+			}
+		}
+	}
+
+	addrs := rootAddresses(records)
+	if len(addrs) == 0 {
+		return 0, errors.New("priming failed: no root server addresses in the answer")
+	}
+
+	r.roots.set(addrs)
+	for _, record := range records {
+		r.cache.Set(record)
+	}
+
+	return max(time.Duration(ttl)*time.Second, minPrimingTTL), nil
+}
+
+// RunPriming primes the root hints and refreshes them whenever the root NS set expires.
+// A forwarding resolver never talks to the roots and returns right away.
+func (r *Resolver) RunPriming(ctx context.Context) {
+	if r.forwarder != nil {
+		return
+	}
+
+	for {
+		wait, err := r.Prime()
+		if err != nil {
+			log.Printf("Root priming error: %v", err)
+			wait = primingRetry
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package resolver
+
+import (
+	"dnsthingymagik/server/recordcache"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const hintsFixture = `; formerly NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+; no TTL, class given, lower case type
+.                        IN           ns    b.root-servers.net
+b.root-servers.net.      IN           a     170.247.170.2
+
+; not a root server, its address is not used
+example.                 172800       NS    ns.example.
+ns.example.              172800       A     192.0.2.53
+; an address without NS, not used either
+c.root-servers.net.      3600000      A     192.33.4.12
+.                        86400        SOA   a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+`
+
+func writeHints(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_ParseRootHints(t *testing.T) {
+	records, err := parseRootHints(writeHints(t, hintsFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ". NS, A.ROOT-SERVERS.NET. A, A.ROOT-SERVERS.NET. AAAA, . NS, b.root-servers.net. A, example. NS, ns.example. A, c.root-servers.net. A"
+	if got := describe(records); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if records[0].TTL != 3600000 || records[3].TTL != 3600000 || records[5].TTL != 172800 {
+		t.Errorf("Expected the file TTL or the default, got %d, %d and %d", records[0].TTL, records[3].TTL, records[5].TTL)
+	}
+
+	for _, broken := range []string{
+		"a.root-servers.net. 3600000 A 2001:503:ba3e::2:30\n",
+		"a.root-servers.net. 3600000 AAAA 198.41.0.4\n",
+		"a.root-servers.net. 3600000 A not-an-address\n",
+	} {
+		if _, err := parseRootHints(writeHints(t, broken)); err == nil {
+			t.Errorf("Expected an error for %q", broken)
+		}
+	}
+	if _, err := parseRootHints(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func Test_RootAddresses(t *testing.T) {
+	records, err := parseRootHints(writeHints(t, hintsFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ip := range rootAddresses(records) {
+		got = append(got, ip.String())
+	}
+	want := []string{"198.41.0.4", "2001:503:ba3e::2:30", "170.247.170.2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected only the addresses of the root NS targets %v, got %v", want, got)
+	}
+}
+
+func Test_LoadRootHints(t *testing.T) {
+	cache := recordcache.NewCache()
+	t.Cleanup(cache.Close)
+	r := NewResolver(cache)
+	if err := r.LoadRootHints(writeHints(t, hintsFixture)); err != nil {
+		t.Fatal(err)
+	}
+	servers := r.roots.servers()
+	slices.Sort(servers)
+	if !slices.Equal(servers, []string{"170.247.170.2", "198.41.0.4", "2001:503:ba3e::2:30"}) {
+		t.Errorf("Expected the roots from the file, got %v", servers)
+	}
+	if servers := r.roots.servers(); net.ParseIP(servers[len(servers)-1]).To4() != nil {
+		t.Errorf("Expected IPv4 roots first, got %v", servers)
+	}
+
+	// Hints without any root address keep the current roots
+	if err := r.LoadRootHints(writeHints(t, "example. 172800 NS ns.example.\nns.example. 172800 A 192.0.2.53\n")); err == nil {
+		t.Error("Expected an error for hints without root addresses")
+	}
+	if len(r.roots.servers()) != 3 {
+		t.Errorf("Expected the roots to stay, got %v", r.roots.servers())
+	}
+}
+
+func Test_Prime(t *testing.T) {
+	// Roots are asked on port 53, the stub root takes a loopback address of its own
+	pc, err := net.ListenPacket("udp", "127.0.0.253:53")
+	if err != nil {
+		t.Skipf("Cannot listen on port 53: %v", err)
+	}
+	var authoritative atomic.Bool
+	root := serveStub(t, pc, func(q dnsmessage.Question) *dnsmessage.Message {
+		if q.Type != dnsmessage.TypeNS || q.Name.String() != "." {
+			return &dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}
+		}
+		return &dnsmessage.Message{
+			Header: dnsmessage.Header{Authoritative: authoritative.Load()},
+			Answers: []dnsmessage.Resource{
+				{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 7200},
+					Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("a.root.test.")},
+				},
+				{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 10800},
+					Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("b.root.test.")},
+				},
+			},
+			Additionals: []dnsmessage.Resource{aResource("a.root.test.", 10), aResource("b.root.test.", 11), aResource("elsewhere.test.", 12)},
+		}
+	})
+
+	cache := recordcache.NewCache()
+	t.Cleanup(cache.Close)
+	r := NewResolver(cache)
+
+	// A non-authoritative answer does not replace the hints
+	r.roots.set([]net.IP{net.ParseIP("127.0.0.253")})
+	if _, err := r.Prime(); err == nil {
+		t.Error("Expected priming to fail on a non-authoritative answer")
+	}
+	if servers := r.roots.servers(); !slices.Equal(servers, []string{"127.0.0.253"}) {
+		t.Errorf("Expected the hints to stay, got %v", servers)
+	}
+
+	authoritative.Store(true)
+	refresh, err := r.Prime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh != 2*time.Hour {
+		t.Errorf("Expected a refresh after the lowest NS TTL, got %s", refresh)
+	}
+	servers := r.roots.servers()
+	slices.Sort(servers)
+	if !slices.Equal(servers, []string{"192.0.2.10", "192.0.2.11"}) {
+		t.Errorf("Expected the primed root addresses, got %v", servers)
+	}
+	if cached, found := cache.Get(dnsmessage.MustNewName("."), dnsmessage.TypeNS); !found || len(cached.Answers) != 2 {
+		t.Errorf("Expected the root NS set cached, got %v %+v", found, cached)
+	}
+	if root.queries() != 2 {
+		t.Errorf("Expected one query per priming, got %d", root.queries())
+	}
+}
@@ -7,10 +7,56 @@ import (
 )
 
 type Record struct {
-	IP       net.IP
+	Body     dnsmessage.ResourceBody // typed RDATA, *dnsmessage.UnknownResource for types the parser does not know
 	RType    dnsmessage.Type
 	TTL      uint32
 	Class    dnsmessage.Class
 	Name     dnsmessage.Name
 	ExpireAt time.Time
 }
+
+// NewRecord copies a parsed resource into a Record.
+func NewRecord(resource dnsmessage.Resource) Record {
+	return Record{
+		Body:  resource.Body,
+		RType: resource.Header.Type,
+		TTL:   resource.Header.TTL,
+		Class: resource.Header.Class,
+		Name:  resource.Header.Name,
+	}
+}
+
+// Resource converts the record back into a resource for a reply message.
+func (r Record) Resource() dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  r.Name,
+			Type:  r.RType,
+			Class: r.Class,
+			TTL:   r.TTL,
+		},
+		Body: r.Body,
+	}
+}
+
+// IP returns the address of an A or AAAA record, nil for other types.
+func (r Record) IP() net.IP {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:])
+	}
+	return nil
+}
+
+// Equal reports whether both records hold the same data, ignoring TTL.
+func (r Record) Equal(other Record) bool {
+	if r.Name != other.Name || r.RType != other.RType || r.Class != other.Class {
+		return false
+	}
+	if r.Body == nil || other.Body == nil {
+		return r.Body == other.Body
+	}
+	return r.Body.GoString() == other.Body.GoString()
+}
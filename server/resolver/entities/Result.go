@@ -0,0 +1,21 @@
+package entities
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Result is the outcome of resolving a single question.
+type Result struct {
+	RCode     dnsmessage.RCode
+	Answers   []Record // the requested records, preceded by the CNAME chain leading to them
+	Authority []Record // SOA of the zone for NXDOMAIN and NODATA answers, RFC 2308
+	// Answered from data configured on this server rather than resolved (AA flag)
+	Authoritative bool
+	// EDNS options for the reply, like an Extended DNS Error explaining a block
+	Options []dnsmessage.Option
+}
+
+// NoData reports a NOERROR answer without any records for the question.
+func (r Result) NoData() bool {
+	return r.RCode == dnsmessage.RCodeSuccess && len(r.Answers) == 0
+}
@@ -0,0 +1,240 @@
+package entities
+
+import (
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Type mnemonics accepted in configuration files, anything else uses the TYPEnnn form
+var typeNames = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+	"CAA":   dnsmessage.Type(257),
+	"HTTPS": dnsmessage.Type(65),
+	"SVCB":  dnsmessage.Type(64),
+}
+
+// ParseType parses a type mnemonic such as "MX" or the generic "TYPE65280" form (RFC 3597).
+func ParseType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(s)
+	if t, ok := typeNames[s]; ok {
+		return t, nil
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		t, err := strconv.ParseUint(n, 10, 16)
+		if err == nil {
+			return dnsmessage.Type(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+// ParseRecord builds a record from its presentation format RDATA, e.g. "10 mail.example.com."
+// for MX. Names without a trailing dot are taken as fully qualified. Types without a parser
+// here are accepted in the generic "\# length hex" form.
+func ParseRecord(name string, rtype dnsmessage.Type, ttl uint32, rdata string) (Record, error) {
+	owner, err := dnsmessage.NewName(FQDN(name))
+	if err != nil {
+		return Record{}, err
+	}
+
+	body, err := parseBody(rtype, rdata)
+	if err != nil {
+		return Record{}, fmt.Errorf("%s %s %q: %w", name, rtype, rdata, err)
+	}
+
+	return Record{
+		Body:  body,
+		RType: rtype,
+		TTL:   ttl,
+		Class: dnsmessage.ClassINET,
+		Name:  owner,
+	}, nil
+}
+
+func parseBody(rtype dnsmessage.Type, rdata string) (dnsmessage.ResourceBody, error) {
+	fields := strings.Fields(rdata)
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGeneric(rtype, fields[1:])
+	}
+
+	switch rtype {
+	case dnsmessage.TypeA:
+		ip := net.ParseIP(rdata).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address")
+		}
+		return &dnsmessage.AResource{A: [4]byte(ip)}, nil
+	case dnsmessage.TypeAAAA:
+		ip := net.ParseIP(rdata)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address")
+		}
+		return &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}, nil
+	case dnsmessage.TypeCNAME, dnsmessage.TypeNS, dnsmessage.TypePTR:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("expected a single name")
+		}
+		target, err := dnsmessage.NewName(FQDN(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+		switch rtype {
+		case dnsmessage.TypeCNAME:
+			return &dnsmessage.CNAMEResource{CNAME: target}, nil
+		case dnsmessage.TypeNS:
+			return &dnsmessage.NSResource{NS: target}, nil
+		default:
+			return &dnsmessage.PTRResource{PTR: target}, nil
+		}
+	case dnsmessage.TypeMX:
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected preference and exchange")
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		mx, err := dnsmessage.NewName(FQDN(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.MXResource{Pref: uint16(pref), MX: mx}, nil
+	case dnsmessage.TypeTXT:
+		txt, err := parseStrings(rdata)
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.TXTResource{TXT: txt}, nil
+	case dnsmessage.TypeSRV:
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("expected priority, weight, port and target")
+		}
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			nums[i] = uint16(n)
+		}
+		target, err := dnsmessage.NewName(FQDN(fields[3]))
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.SRVResource{Priority: nums[0], Weight: nums[1], Port: nums[2], Target: target}, nil
+	case dnsmessage.TypeSOA:
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("expected mname, rname, serial, refresh, retry, expire and minimum")
+		}
+		ns, err := dnsmessage.NewName(FQDN(fields[0]))
+		if err != nil {
+			return nil, err
+		}
+		mbox, err := dnsmessage.NewName(FQDN(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		var nums [5]uint32
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[2+i], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			nums[i] = uint32(n)
+		}
+		return &dnsmessage.SOAResource{NS: ns, MBox: mbox, Serial: nums[0], Refresh: nums[1], Retry: nums[2], Expire: nums[3], MinTTL: nums[4]}, nil
+	case typeNames["CAA"]:
+		// RFC 8659: flags, tag and value, carried as opaque RDATA
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("expected flags, tag and value")
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		tag := fields[1]
+		value, err := parseStrings(strings.Join(fields[2:], " "))
+		if err != nil {
+			return nil, err
+		}
+		data := append([]byte{byte(flags), byte(len(tag))}, tag...)
+		data = append(data, strings.Join(value, "")...)
+		return &dnsmessage.UnknownResource{Type: rtype, Data: data}, nil
+	}
+
+	return nil, fmt.Errorf(`no parser for this type, use the \# form`)
+}
+
+// RFC 3597 section 5: \# <length> <hex>...
+func parseGeneric(rtype dnsmessage.Type, fields []string) (dnsmessage.ResourceBody, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf(`\# needs a length`)
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf(`\# length %d does not match %d bytes of data`, length, len(data))
+	}
+	return &dnsmessage.UnknownResource{Type: rtype, Data: data}, nil
+}
+
+// Split character-strings: quoted strings keep their spaces, bare words stand alone.
+func parseStrings(s string) ([]string, error) {
+	var out []string
+	s = strings.TrimSpace(s)
+	for s != "" {
+		if s[0] == '"' {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			out = append(out, b.String())
+			s = strings.TrimSpace(s[i+1:])
+			continue
+		}
+
+		word, rest, _ := strings.Cut(s, " ")
+		out = append(out, word)
+		s = strings.TrimSpace(rest)
+	}
+
+	for _, str := range out {
+		if len(str) > 255 {
+			return nil, fmt.Errorf("character-string longer than 255 bytes")
+		}
+	}
+	return out, nil
+}
+
+// FQDN adds the trailing dot of an absolute name when it is missing.
+func FQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
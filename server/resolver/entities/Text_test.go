@@ -0,0 +1,122 @@
+package entities
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"testing"
+)
+
+func Test_ParseType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want dnsmessage.Type
+		err  bool
+	}{
+		{in: "A", want: dnsmessage.TypeA},
+		{in: "aaaa", want: dnsmessage.TypeAAAA},
+		{in: "Mx", want: dnsmessage.TypeMX},
+		{in: "CAA", want: dnsmessage.Type(257)},
+		{in: "HTTPS", want: dnsmessage.Type(65)},
+		{in: "TYPE65280", want: dnsmessage.Type(65280)},
+		{in: "type99", want: dnsmessage.Type(99)},
+		{in: "TYPE65536", err: true},
+		{in: "TYPE", err: true},
+		{in: "NAPTR", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseType(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseType(%q): expected %v (error %v), got %v %v", tt.in, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func Test_ParseRecord(t *testing.T) {
+	name := func(s string) dnsmessage.Name { return dnsmessage.MustNewName(s) }
+	tests := []struct {
+		rtype dnsmessage.Type
+		rdata string
+		want  dnsmessage.ResourceBody
+	}{
+		{dnsmessage.TypeA, "192.0.2.1", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+		{dnsmessage.TypeAAAA, "2001:db8::1", &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+		{dnsmessage.TypeCNAME, "target.example.com", &dnsmessage.CNAMEResource{CNAME: name("target.example.com.")}},
+		{dnsmessage.TypeNS, "ns1.example.com.", &dnsmessage.NSResource{NS: name("ns1.example.com.")}},
+		{dnsmessage.TypePTR, "host.example.com", &dnsmessage.PTRResource{PTR: name("host.example.com.")}},
+		{dnsmessage.TypeMX, "10 mail.example.com", &dnsmessage.MXResource{Pref: 10, MX: name("mail.example.com.")}},
+		{dnsmessage.TypeTXT, `"v=spf1 mx -all"`, &dnsmessage.TXTResource{TXT: []string{"v=spf1 mx -all"}}},
+		{dnsmessage.TypeTXT, `"a b" c "say \"hi\""`, &dnsmessage.TXTResource{TXT: []string{"a b", "c", `say "hi"`}}},
+		{dnsmessage.TypeTXT, `bare`, &dnsmessage.TXTResource{TXT: []string{"bare"}}},
+		{dnsmessage.TypeSRV, "0 5 389 ldap.example.com", &dnsmessage.SRVResource{Priority: 0, Weight: 5, Port: 389, Target: name("ldap.example.com.")}},
+		{
+			dnsmessage.TypeSOA, "ns.example.com. hostmaster.example.com. 2024010101 3600 600 86400 300",
+			&dnsmessage.SOAResource{NS: name("ns.example.com."), MBox: name("hostmaster.example.com."), Serial: 2024010101, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 300},
+		},
+		{dnsmessage.Type(257), `0 issue "letsencrypt.org"`, &dnsmessage.UnknownResource{Type: 257, Data: append([]byte{0, 5}, "issueletsencrypt.org"...)}},
+		{dnsmessage.Type(65280), `\# 3 abcdef`, &dnsmessage.UnknownResource{Type: 65280, Data: []byte{0xab, 0xcd, 0xef}}},
+		{dnsmessage.Type(65280), `\# 4 0102 0304`, &dnsmessage.UnknownResource{Type: 65280, Data: []byte{1, 2, 3, 4}}},
+		{dnsmessage.Type(65280), `\# 0`, &dnsmessage.UnknownResource{Type: 65280, Data: []byte{}}},
+		// A known type may be written in the generic form too
+		{dnsmessage.TypeA, `\# 4 c0000201`, &dnsmessage.UnknownResource{Type: dnsmessage.TypeA, Data: []byte{192, 0, 2, 1}}},
+	}
+
+	for _, tt := range tests {
+		record, err := ParseRecord("host.example.com", tt.rtype, 300, tt.rdata)
+		if err != nil {
+			t.Errorf("%s %q: unexpected error %v", tt.rtype, tt.rdata, err)
+			continue
+		}
+		if record.Name.String() != "host.example.com." || record.RType != tt.rtype || record.TTL != 300 || record.Class != dnsmessage.ClassINET {
+			t.Errorf("%s %q: wrong header %v %v %d %v", tt.rtype, tt.rdata, record.Name, record.RType, record.TTL, record.Class)
+		}
+		if got, want := record.Body.GoString(), tt.want.GoString(); got != want {
+			t.Errorf("%s %q:\nexpected %s\ngot      %s", tt.rtype, tt.rdata, want, got)
+		}
+
+		// Everything parsed must also pack
+		msg := dnsmessage.Message{Answers: []dnsmessage.Resource{record.Resource()}}
+		if _, err := msg.Pack(); err != nil {
+			t.Errorf("%s %q: does not pack: %v", tt.rtype, tt.rdata, err)
+		}
+	}
+}
+
+func Test_ParseRecordErrors(t *testing.T) {
+	tests := []struct {
+		rtype dnsmessage.Type
+		rdata string
+	}{
+		{dnsmessage.TypeA, "2001:db8::1"},
+		{dnsmessage.TypeA, "300.0.0.1"},
+		{dnsmessage.TypeAAAA, "192.0.2.1"},
+		{dnsmessage.TypeCNAME, "a.example. b.example."},
+		{dnsmessage.TypeMX, "mail.example.com"},
+		{dnsmessage.TypeMX, "70000 mail.example.com"},
+		{dnsmessage.TypeTXT, `"unterminated`},
+		{dnsmessage.TypeTXT, `"` + strings.Repeat("x", 256) + `"`},
+		{dnsmessage.TypeSRV, "0 5 ldap.example.com"},
+		{dnsmessage.TypeSOA, "ns.example.com. hostmaster.example.com. 1 2 3 4"},
+		{dnsmessage.Type(257), "0 issue"},
+		{dnsmessage.Type(65280), "abcdef"}, // no parser, needs the generic form
+		{dnsmessage.Type(65280), `\#`},
+		{dnsmessage.Type(65280), `\# 2 abcdef`},
+		{dnsmessage.Type(65280), `\# 1 zz`},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRecord("host.example.com", tt.rtype, 300, tt.rdata); err == nil {
+			t.Errorf("%s %q: expected an error", tt.rtype, tt.rdata)
+		}
+	}
+
+	if _, err := ParseRecord(strings.Repeat("a.", 130)+"example", dnsmessage.TypeA, 300, "192.0.2.1"); err == nil {
+		t.Error("Expected an overlong owner name to fail")
+	}
+}
+
+func Test_FQDN(t *testing.T) {
+	for in, want := range map[string]string{"example.com": "example.com.", "example.com.": "example.com.", ".": "."} {
+		if got := FQDN(in); got != want {
+			t.Errorf("FQDN(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
@@ -1,33 +1,122 @@
 package query
 
 import (
+	"context"
+	"dnsthingymagik/server/edns"
+	"encoding/binary"
+	"errors"
 	"golang.org/x/net/dns/dnsmessage"
+	"io"
 	"net"
 	"time"
 )
 
-func SendQuery(server string, query dnsmessage.Message) (dnsmessage.Message, error) {
-	conn, err := net.DialTimeout("udp", server+":53", 5*time.Second)
+const defaultTimeout = 5 * time.Second // used when ctx carries no deadline
+
+// SendQuery sends query to server and returns its answer, giving up when ctx is done.
+func SendQuery(ctx context.Context, server string, query dnsmessage.Message) (dnsmessage.Message, error) {
+	opt, err := edns.Parse(query)
 	if err != nil {
 		return dnsmessage.Message{}, err
 	}
-	defer conn.Close()
 
-	q, err := query.Pack()
+	// Advertise a larger receive buffer unless the caller set up EDNS itself
+	withEDNS := query
+	if opt == nil {
+		withEDNS.Additionals = append(append([]dnsmessage.Resource{}, query.Additionals...), edns.NewOPT(edns.DefaultUDPSize, dnsmessage.RCodeSuccess, false))
+	}
+
+	msg, q, err := exchangeUDP(ctx, server, withEDNS)
 	if err != nil {
 		return dnsmessage.Message{}, err
 	}
 
-	_, err = conn.Write(q)
+	// Servers that predate RFC 6891 reject the OPT record, fall back to plain DNS
+	if opt == nil && rejectsEDNS(msg) {
+		msg, q, err = exchangeUDP(ctx, server, query)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+	}
+
+	// The answer did not fit into a datagram, ask again over TCP for the full message
+	if msg.Header.Truncated {
+		return sendTCP(ctx, server, q)
+	}
+
+	return msg, nil
+}
+
+func rejectsEDNS(msg dnsmessage.Message) bool {
+	if msg.Header.RCode == dnsmessage.RCodeFormatError || msg.Header.RCode == dnsmessage.RCodeNotImplemented {
+		return true
+	}
+
+	opt, err := edns.Parse(msg)
+	return err == nil && opt != nil && msg.Header.RCode|dnsmessage.RCode(opt.ExtendedRCode)<<4 == edns.RCodeBadVersion
+}
+
+func exchangeUDP(ctx context.Context, server string, query dnsmessage.Message) (dnsmessage.Message, []byte, error) {
+	q, err := query.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, nil, err
+	}
+
+	msg, err := sendUDP(ctx, server, q, udpBufferSize(query))
+	return msg, q, err
+}
+
+func udpBufferSize(query dnsmessage.Message) int {
+	opt, err := edns.Parse(query)
+	if err != nil {
+		return edns.MinUDPSize
+	}
+	return opt.MaxPayload()
+}
+
+// Upstream address with the default DNS port unless one is given.
+func address(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+func deadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(defaultTimeout)
+}
+
+func dial(ctx context.Context, network string, server string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address(server))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(deadline(ctx))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func sendUDP(ctx context.Context, server string, q []byte, bufSize int) (dnsmessage.Message, error) {
+	conn, err := dial(ctx, "udp", server)
 	if err != nil {
 		return dnsmessage.Message{}, err
 	}
+	defer conn.Close()
 
-	buf := make([]byte, 512)
-	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(q)
 	if err != nil {
 		return dnsmessage.Message{}, err
 	}
+
+	buf := make([]byte, bufSize)
 	n, err := conn.Read(buf)
 	if err != nil {
 		return dnsmessage.Message{}, err
@@ -35,6 +124,52 @@ func SendQuery(server string, query dnsmessage.Message) (dnsmessage.Message, err
 
 	msg := dnsmessage.Message{}
 	err = msg.Unpack(buf[:n])
+	if err != nil {
+		// A truncated reply may be cut mid-record, the header alone is enough to retry over TCP
+		var parser dnsmessage.Parser
+		header, herr := parser.Start(buf[:n])
+		if herr == nil && header.Truncated {
+			return dnsmessage.Message{Header: header}, nil
+		}
+		return dnsmessage.Message{}, err
+	}
+
+	return msg, nil
+}
+
+func sendTCP(ctx context.Context, server string, q []byte) (dnsmessage.Message, error) {
+	conn, err := dial(ctx, "tcp", server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+
+	if len(q) > 0xFFFF {
+		return dnsmessage.Message{}, errors.New("query too large for TCP framing")
+	}
+	frame := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(frame, uint16(len(q)))
+	copy(frame[2:], q)
+
+	_, err = conn.Write(frame)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	prefix := make([]byte, 2)
+	_, err = io.ReadFull(conn, prefix)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(prefix))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	msg := dnsmessage.Message{}
+	err = msg.Unpack(buf)
 	if err != nil {
 		return dnsmessage.Message{}, err
 	}
@@ -0,0 +1,280 @@
+package query
+
+import (
+	"context"
+	"dnsthingymagik/server/edns"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A server on one loopback port for both UDP and TCP. reply builds the raw answer to a
+// query, nil sends nothing.
+type stub struct {
+	addr  string
+	reply func(q dnsmessage.Message, tcp bool) []byte
+
+	mu      sync.Mutex
+	queries []seen
+}
+
+type seen struct {
+	tcp  bool
+	edns bool
+}
+
+func newStub(t *testing.T, reply func(q dnsmessage.Message, tcp bool) []byte) *stub {
+	t.Helper()
+	s := &stub{reply: reply}
+
+	// The same port for both, retried in the rare case UDP has it taken
+	var ln net.Listener
+	var pc net.PacketConn
+	for i := 0; ; i++ {
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err = net.ListenPacket("udp", ln.Addr().String())
+		if err == nil {
+			break
+		}
+		ln.Close()
+		if i == 10 {
+			t.Fatal(err)
+		}
+	}
+	s.addr = ln.Addr().String()
+	t.Cleanup(func() {
+		ln.Close()
+		pc.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if out := s.answer(buf[:n], false); out != nil {
+				pc.WriteTo(out, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				prefix := make([]byte, 2)
+				if _, err := io.ReadFull(conn, prefix); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(prefix))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if out := s.answer(buf, true); out != nil {
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *stub) answer(buf []byte, tcp bool) []byte {
+	var q dnsmessage.Message
+	if q.Unpack(buf) != nil {
+		return nil
+	}
+	opt, _ := edns.Parse(q)
+	s.mu.Lock()
+	s.queries = append(s.queries, seen{tcp: tcp, edns: opt != nil})
+	s.mu.Unlock()
+	return s.reply(q, tcp)
+}
+
+func (s *stub) seen() []seen {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]seen{}, s.queries...)
+}
+
+func question() dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+}
+
+// A reply to q with the given number of A records, packed.
+func reply(t *testing.T, q dnsmessage.Message, rcode dnsmessage.RCode, answers int, truncated bool, additionals ...dnsmessage.Resource) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: q.Header.ID, Response: true, RCode: rcode, Truncated: truncated},
+		Questions:   q.Questions,
+		Additionals: additionals,
+	}
+	for i := 0; i < answers; i++ {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func send(t *testing.T, s *stub, q dnsmessage.Message) (dnsmessage.Message, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return SendQuery(ctx, s.addr, q)
+}
+
+func Test_TruncatedRetriesOverTCP(t *testing.T) {
+	tests := []struct {
+		name string
+		udp  func(t *testing.T, q dnsmessage.Message) []byte
+	}{
+		{
+			name: "TC with a partial answer",
+			udp: func(t *testing.T, q dnsmessage.Message) []byte {
+				return reply(t, q, dnsmessage.RCodeSuccess, 1, true)
+			},
+		},
+		{
+			name: "datagram cut in the middle of a record",
+			udp: func(t *testing.T, q dnsmessage.Message) []byte {
+				full := reply(t, q, dnsmessage.RCodeSuccess, 3, true)
+				return full[:len(full)-7]
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		s := newStub(t, func(q dnsmessage.Message, tcp bool) []byte {
+			if tcp {
+				return reply(t, q, dnsmessage.RCodeSuccess, 50, false)
+			}
+			return tt.udp(t, q)
+		})
+
+		msg, err := send(t, s, question())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if msg.Header.Truncated || len(msg.Answers) != 50 {
+			t.Errorf("%s: expected the full answer over TCP, got %d answers (TC=%v)", tt.name, len(msg.Answers), msg.Header.Truncated)
+		}
+		queries := s.seen()
+		if len(queries) != 2 || queries[0].tcp || !queries[1].tcp {
+			t.Errorf("%s: expected one UDP then one TCP query, got %+v", tt.name, queries)
+		}
+	}
+}
+
+func Test_CutDatagramWithoutTC(t *testing.T) {
+	s := newStub(t, func(q dnsmessage.Message, tcp bool) []byte {
+		full := reply(t, q, dnsmessage.RCodeSuccess, 3, false)
+		return full[:len(full)-7]
+	})
+	if _, err := send(t, s, question()); err == nil {
+		t.Error("Expected a broken reply without TC to fail")
+	}
+	if queries := s.seen(); len(queries) != 1 {
+		t.Errorf("Expected no retry, got %+v", queries)
+	}
+}
+
+func Test_EDNSFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		rcode      dnsmessage.RCode
+		badVersion bool // BADVERS in the OPT of the reply
+		fallback   bool
+	}{
+		{name: "FORMERR", rcode: dnsmessage.RCodeFormatError, fallback: true},
+		{name: "NOTIMP", rcode: dnsmessage.RCodeNotImplemented, fallback: true},
+		{name: "BADVERS", badVersion: true, fallback: true},
+		{name: "SERVFAIL is not about EDNS", rcode: dnsmessage.RCodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		s := newStub(t, func(q dnsmessage.Message, tcp bool) []byte {
+			if opt, _ := edns.Parse(q); opt != nil {
+				if tt.badVersion {
+					return reply(t, q, dnsmessage.RCodeSuccess, 0, false, edns.NewOPT(edns.DefaultUDPSize, edns.RCodeBadVersion, false))
+				}
+				return reply(t, q, tt.rcode, 0, false)
+			}
+			return reply(t, q, dnsmessage.RCodeSuccess, 1, false)
+		})
+
+		msg, err := send(t, s, question())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		queries := s.seen()
+		if !queries[0].edns {
+			t.Errorf("%s: expected the first query to carry EDNS", tt.name)
+		}
+		if !tt.fallback {
+			if len(queries) != 1 || msg.Header.RCode != dnsmessage.RCodeServerFailure {
+				t.Errorf("%s: expected no retry, got %+v and %s", tt.name, queries, msg.Header.RCode)
+			}
+			continue
+		}
+		if len(queries) != 2 || queries[1].edns {
+			t.Errorf("%s: expected a retry without EDNS, got %+v", tt.name, queries)
+		}
+		if msg.Header.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Errorf("%s: expected the plain DNS answer, got %s with %d answers", tt.name, msg.Header.RCode, len(msg.Answers))
+		}
+	}
+}
+
+func Test_CallerEDNSIsNotDropped(t *testing.T) {
+	s := newStub(t, func(q dnsmessage.Message, tcp bool) []byte {
+		return reply(t, q, dnsmessage.RCodeFormatError, 0, false)
+	})
+	q := question()
+	q.Additionals = []dnsmessage.Resource{edns.NewOPT(4096, dnsmessage.RCodeSuccess, true)}
+
+	msg, err := send(t, s, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries := s.seen(); len(queries) != 1 || msg.Header.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("Expected the caller's OPT to be kept and the FORMERR returned, got %+v and %s", queries, msg.Header.RCode)
+	}
+}
+
+func Test_Timeout(t *testing.T) {
+	s := newStub(t, func(dnsmessage.Message, bool) []byte { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := SendQuery(ctx, s.addr, question()); err == nil {
+		t.Fatal("Expected a silent server to time out")
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Expected to give up with the context, took %s", waited)
+	}
+}
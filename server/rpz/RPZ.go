@@ -0,0 +1,488 @@
+package rpz
+
+import (
+	"dnsthingymagik/server/edns"
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrDrop means the question is not answered at all (rpz-drop).
+var ErrDrop = errors.New("dropped by response policy")
+
+type Action int
+
+const (
+	ActionNXDomain  Action = iota // CNAME .
+	ActionNoData                  // CNAME *.
+	ActionPassthru                // CNAME rpz-passthru.
+	ActionDrop                    // CNAME rpz-drop.
+	ActionLocalData               // any other records
+)
+
+// Special owner suffixes and CNAME targets, https://datatracker.ietf.org/doc/draft-vixie-dnsop-dns-rpz/
+const (
+	ipLabel       = "rpz-ip"
+	nsdnameLabel  = "rpz-nsdname"
+	nsipLabel     = "rpz-nsip"
+	clientIPLabel = "rpz-client-ip"
+
+	passthruTarget = "rpz-passthru."
+	dropTarget     = "rpz-drop."
+	tcpOnlyTarget  = "rpz-tcp-only."
+)
+
+// Zone is the file of a policy zone to load.
+type Zone struct {
+	Name string // origin of the zone, names in the file are relative to it
+	Path string
+}
+
+// Policy is the action a trigger of a zone calls for.
+type Policy struct {
+	Zone    string
+	Trigger string // owner of the trigger in the zone, for logs
+	Action  Action
+	records []entities.Record // local data, owners are replaced by the question
+	soa     *entities.Record
+	zone    int // position of the zone in load order
+}
+
+// RPZ applies response policy zones. Zones are checked in the order they are loaded
+// and the first one with a matching trigger decides. Within a zone the QNAME trigger
+// comes first, then response IP, NSDNAME and NSIP triggers. A QNAME trigger is known
+// before resolving, but only decides once no zone before it matches the response.
+type RPZ struct {
+	zones []*zone
+}
+
+type zone struct {
+	name      string
+	soa       *entities.Record
+	qnames    nameTriggers
+	ips       []ipTrigger
+	nsdnames  nameTriggers
+	nsips     []ipTrigger
+	policyCnt int
+}
+
+// Exact names and wildcards, keyed by the name below the "*"
+type nameTriggers struct {
+	exact     map[string]*Policy
+	wildcards map[string]*Policy
+}
+
+type ipTrigger struct {
+	network *net.IPNet
+	policy  *Policy
+}
+
+// Load reads the policy zones, a zone that fails to parse fails the load.
+func Load(zones []Zone) (*RPZ, error) {
+	r := &RPZ{}
+	for i, z := range zones {
+		loaded, err := loadZone(z, i)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("RPZ zone %s: %d triggers", loaded.name, loaded.policyCnt)
+		r.zones = append(r.zones, loaded)
+	}
+	return r, nil
+}
+
+func loadZone(z Zone, index int) (*zone, error) {
+	origin := entities.FQDN(strings.ToLower(z.Name))
+	records, err := parseZoneFile(z.Path, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := &zone{
+		name:     origin,
+		qnames:   newNameTriggers(),
+		nsdnames: newNameTriggers(),
+	}
+	policies := make(map[string]*Policy)
+	var order []string
+	for _, record := range records {
+		errorf := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", z.Path, record.line, fmt.Sprintf(format, args...))
+		}
+
+		if record.owner == origin {
+			// SOA and NS of the zone itself, the SOA goes into negative answers
+			if record.rtype == "SOA" {
+				soa, err := entities.ParseRecord(origin, dnsmessage.TypeSOA, record.ttl, record.rdata)
+				if err != nil {
+					return nil, errorf("%v", err)
+				}
+				loaded.soa = &soa
+			}
+			continue
+		}
+		if !strings.HasSuffix(record.owner, "."+origin) {
+			return nil, errorf("%s is outside the zone %s", record.owner, origin)
+		}
+
+		policy, ok := policies[record.owner]
+		if !ok {
+			policy = &Policy{Zone: origin, Trigger: record.owner, Action: ActionLocalData, zone: index}
+			policies[record.owner] = policy
+			order = append(order, record.owner)
+		}
+		err := policy.add(record)
+		if err != nil {
+			return nil, errorf("%v", err)
+		}
+	}
+
+	for _, owner := range order {
+		policy := policies[owner]
+		policy.soa = loaded.soa
+		err := loaded.addTrigger(strings.TrimSuffix(owner, "."+origin), policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", z.Path, owner, err)
+		}
+	}
+	return loaded, nil
+}
+
+// Add a record at the trigger's owner: a special CNAME sets the action, anything else is local data.
+func (p *Policy) add(record rr) error {
+	rtype, err := entities.ParseType(record.rtype)
+	if err != nil {
+		return err
+	}
+
+	if rtype == dnsmessage.TypeCNAME {
+		action := ActionLocalData
+		switch strings.ToLower(entities.FQDN(record.rdata)) {
+		case ".":
+			action = ActionNXDomain
+		case "*.":
+			action = ActionNoData
+		case passthruTarget:
+			action = ActionPassthru
+		case dropTarget:
+			action = ActionDrop
+		case tcpOnlyTarget:
+			return fmt.Errorf("rpz-tcp-only is not supported")
+		}
+		if action != ActionLocalData {
+			if len(p.records) > 0 {
+				return fmt.Errorf("%s cannot mix an action with local data", record.owner)
+			}
+			p.Action = action
+			return nil
+		}
+	}
+
+	if p.Action != ActionLocalData {
+		return fmt.Errorf("%s cannot mix an action with local data", record.owner)
+	}
+	local, err := entities.ParseRecord(record.owner, rtype, record.ttl, record.rdata)
+	if err != nil {
+		return err
+	}
+	p.records = append(p.records, local)
+	return nil
+}
+
+// Sort a trigger by the label its owner ends in.
+func (z *zone) addTrigger(owner string, policy *Policy) error {
+	z.policyCnt++
+	labels := strings.Split(owner, ".")
+	switch labels[len(labels)-1] {
+	case ipLabel, nsipLabel:
+		network, err := parseIPTrigger(labels[:len(labels)-1])
+		if err != nil {
+			return err
+		}
+		trigger := ipTrigger{network: network, policy: policy}
+		if labels[len(labels)-1] == ipLabel {
+			z.ips = append(z.ips, trigger)
+		} else {
+			z.nsips = append(z.nsips, trigger)
+		}
+	case nsdnameLabel:
+		z.nsdnames.add(strings.Join(labels[:len(labels)-1], "."), policy)
+	case clientIPLabel:
+		z.policyCnt--
+		log.Printf("RPZ zone %s: client IP trigger %s is not supported, ignored", z.name, owner)
+	default:
+		z.qnames.add(owner, policy)
+	}
+	return nil
+}
+
+// IP triggers are written as prefix length followed by the address reversed, by octet for
+// IPv4 (32.1.2.0.192 is 192.0.2.1/32) and by 16 bit word for IPv6 with zz for :: .
+func parseIPTrigger(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("IP trigger needs a prefix length and an address")
+	}
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix length %q", labels[0])
+	}
+
+	parts := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i >= 1; i-- {
+		parts = append(parts, labels[i])
+	}
+
+	var addr string
+	bits := 128
+	if len(parts) == 4 && !slices.Contains(parts, "zz") {
+		addr, bits = strings.Join(parts, "."), 32
+	} else {
+		for i, part := range parts {
+			if part == "zz" {
+				parts[i] = ""
+			}
+		}
+		addr = strings.Join(parts, ":")
+		// zz at either end leaves a single colon there
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		}
+		if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || prefix < 0 || prefix > bits {
+		return nil, fmt.Errorf("invalid IP trigger %s", strings.Join(labels, "."))
+	}
+	mask := net.CIDRMask(prefix, bits)
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func newNameTriggers() nameTriggers {
+	return nameTriggers{exact: make(map[string]*Policy), wildcards: make(map[string]*Policy)}
+}
+
+func (t nameTriggers) add(name string, policy *Policy) {
+	name = entities.FQDN(name)
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		t.wildcards[rest] = policy
+		return
+	}
+	t.exact[name] = policy
+}
+
+func (t nameTriggers) empty() bool {
+	return len(t.exact) == 0 && len(t.wildcards) == 0
+}
+
+// Exact trigger first, then the wildcard closest to the name.
+func (t nameTriggers) match(name string) *Policy {
+	if policy, ok := t.exact[name]; ok {
+		return policy
+	}
+	for parent := name; parent != "."; {
+		_, rest, _ := strings.Cut(parent, ".")
+		parent = entities.FQDN(rest)
+		if policy, ok := t.wildcards[parent]; ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+// Policy of the trigger covering ip with the longest prefix.
+func matchIP(triggers []ipTrigger, ip net.IP) *Policy {
+	var best *Policy
+	bestLen := -1
+	for _, trigger := range triggers {
+		if !trigger.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := trigger.network.Mask.Size(); ones > bestLen {
+			best, bestLen = trigger.policy, ones
+		}
+	}
+	return best
+}
+
+// QName returns the policy for a question name, checked before resolving it.
+func (r *RPZ) QName(name dnsmessage.Name) *Policy {
+	if r == nil {
+		return nil
+	}
+	key := strings.ToLower(name.String())
+	for _, z := range r.zones {
+		if policy := z.qnames.match(key); policy != nil {
+			return policy
+		}
+	}
+	return nil
+}
+
+// NeedsResponse reports whether a zone before the one of p, or any zone when p is nil,
+// has response triggers, so the answer must be resolved before p can decide.
+func (r *RPZ) NeedsResponse(p *Policy) bool {
+	if r == nil {
+		return false
+	}
+	for _, z := range r.zones[:r.bound(p)] {
+		if z.responseTriggers() {
+			return true
+		}
+	}
+	return false
+}
+
+// Response returns the policy the resolved answer to name triggers in a zone before
+// the one of p, or in any zone when p is nil: an address in the answer, or a name or
+// address of the nameservers of a name in it. nameservers looks those up, it is only
+// called for zones with nameserver triggers and once per name.
+func (r *RPZ) Response(name dnsmessage.Name, result entities.Result, nameservers func(dnsmessage.Name) []entities.Record, p *Policy) *Policy {
+	if r == nil {
+		return nil
+	}
+
+	// The question and the CNAME targets leading to the answer
+	names := []dnsmessage.Name{name}
+	for _, record := range result.Answers {
+		if cname, ok := record.Body.(*dnsmessage.CNAMEResource); ok {
+			names = append(names, cname.CNAME)
+		}
+	}
+	var servers []entities.Record
+	looked := false
+	lookup := func() []entities.Record {
+		if !looked {
+			looked = true
+			for _, owner := range names {
+				servers = append(servers, nameservers(owner)...)
+			}
+		}
+		return servers
+	}
+
+	for _, z := range r.zones[:r.bound(p)] {
+		for _, record := range result.Answers {
+			if ip := record.IP(); ip != nil {
+				if policy := matchIP(z.ips, ip); policy != nil {
+					return policy
+				}
+			}
+		}
+		if !z.nsdnames.empty() {
+			for _, record := range lookup() {
+				if ns, ok := record.Body.(*dnsmessage.NSResource); ok {
+					if policy := z.nsdnames.match(strings.ToLower(ns.NS.String())); policy != nil {
+						return policy
+					}
+				}
+			}
+		}
+		if len(z.nsips) > 0 {
+			for _, record := range lookup() {
+				if ip := record.IP(); ip != nil {
+					if policy := matchIP(z.nsips, ip); policy != nil {
+						return policy
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Number of zones checked for a response before p decides.
+func (r *RPZ) bound(p *Policy) int {
+	if p == nil {
+		return len(r.zones)
+	}
+	return p.zone
+}
+
+func (z *zone) responseTriggers() bool {
+	return len(z.ips) > 0 || !z.nsdnames.empty() || len(z.nsips) > 0
+}
+
+// Answer for a question the policy applies to. Passthru answers nothing, the caller
+// resolves as usual; drop returns ErrDrop. Local data may end in a CNAME the caller follows.
+func (p *Policy) Answer(name dnsmessage.Name, rtype dnsmessage.Type) (entities.Result, error) {
+	result := entities.Result{
+		RCode:   dnsmessage.RCodeSuccess,
+		Options: []dnsmessage.Option{edns.ExtendedError(edns.EDEBlocked, "rpz "+p.Zone)},
+	}
+
+	switch p.Action {
+	case ActionDrop:
+		return entities.Result{}, ErrDrop
+	case ActionNXDomain:
+		result.RCode = dnsmessage.RCodeNameError
+	case ActionLocalData:
+		var cnames []entities.Record
+		for _, record := range p.records {
+			record.Name = name
+			if record.RType == rtype {
+				result.Answers = append(result.Answers, record)
+			} else if record.RType == dnsmessage.TypeCNAME {
+				cnames = append(cnames, wildcardTarget(record, name))
+			}
+		}
+		if len(result.Answers) == 0 {
+			result.Answers = cnames
+		}
+	}
+
+	if len(result.Answers) == 0 && p.soa != nil {
+		result.Authority = []entities.Record{*p.soa}
+	}
+	return result, nil
+}
+
+// A local data CNAME to *.example.net rewrites the question to name.example.net.
+func wildcardTarget(record entities.Record, name dnsmessage.Name) entities.Record {
+	cname := record.Body.(*dnsmessage.CNAMEResource)
+	rest, ok := strings.CutPrefix(cname.CNAME.String(), "*.")
+	if !ok {
+		return record
+	}
+
+	target, err := dnsmessage.NewName(name.String() + rest)
+	if err != nil {
+		// Too long to rewrite, keep the record as written
+		return record
+	}
+	record.Body = &dnsmessage.CNAMEResource{CNAME: target}
+	return record
+}
+
+func (p *Policy) String() string {
+	return fmt.Sprintf("%s (rpz %s)", strings.TrimSuffix(p.Trigger, "."+p.Zone), p.Zone)
+}
+
+// Explain says what the policy does to a question and which trigger of which zone calls for it.
+func (p *Policy) Explain() string {
+	var action string
+	switch p.Action {
+	case ActionNXDomain:
+		action = "answered NXDOMAIN"
+	case ActionNoData:
+		action = "answered NODATA"
+	case ActionPassthru:
+		action = "passed through without the lists"
+	case ActionDrop:
+		action = "dropped"
+	default:
+		action = "answered with local data"
+	}
+	return fmt.Sprintf("%s by trigger %q of rpz %s", action, strings.TrimSuffix(p.Trigger, "."+p.Zone), p.Zone)
+}
@@ -0,0 +1,321 @@
+package rpz
+
+import (
+	"dnsthingymagik/server/resolver/entities"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"testing"
+)
+
+const first = `$TTL 60
+@                          SOA ns.first.rpz. admin.first.rpz. 1 3600 600 86400 60
+32.1.2.0.192.rpz-ip        CNAME .
+ns.evil.net.rpz-nsdname    CNAME rpz-drop.
+24.0.100.51.198.rpz-nsip     CNAME *.
+ok.example.com             CNAME rpz-passthru.
+`
+
+const second = `$TTL 60
+@                          SOA ns.second.rpz. admin.second.rpz. 1 3600 600 86400 60
+*.example.com              CNAME .
+exact.example.com          A     192.0.2.9
+search.example.com         CNAME *.safe.example.
+48.zz.db8.2001.rpz-ip      CNAME *.
+`
+
+func loadZones(t *testing.T, contents ...string) *RPZ {
+	t.Helper()
+	var zones []Zone
+	for i, content := range contents {
+		zones = append(zones, Zone{Name: []string{"first.rpz", "second.rpz"}[i], Path: writeZone(t, content)})
+	}
+	r, err := Load(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func record(t *testing.T, name string, rtype dnsmessage.Type, rdata string) entities.Record {
+	t.Helper()
+	r, err := entities.ParseRecord(name, rtype, 60, rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func Test_ParseIPTrigger(t *testing.T) {
+	tests := []struct {
+		owner string
+		want  string // "" when invalid
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32"},
+		{"24.1.2.0.192", "192.0.2.0/24"}, // host bits are dropped
+		{"0.0.0.0.0", "0.0.0.0/0"},
+		{"48.zz.db8.2001", "2001:db8::/48"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"128.1.zz", "::1/128"},
+		{"33.1.2.0.192", ""},
+		{"129.zz.db8.2001", ""},
+		{"x.1.2.0.192", ""},
+		{"24.1.2.0.300", ""},
+		{"32", ""},
+	}
+	for _, tt := range tests {
+		network, err := parseIPTrigger(strings.Split(tt.owner, "."))
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: expected an error, got %s", tt.owner, network)
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: expected %s, got %v", tt.owner, tt.want, err)
+		case tt.want != "" && network.String() != tt.want:
+			t.Errorf("%s: expected %s, got %s", tt.owner, tt.want, network)
+		}
+	}
+}
+
+func Test_QName(t *testing.T) {
+	r := loadZones(t, first, second)
+
+	tests := []struct {
+		name    string
+		zone    string // "" when nothing matches
+		trigger string
+		action  Action
+	}{
+		{"ok.example.com.", "first.rpz.", "ok.example.com.first.rpz.", ActionPassthru},
+		{"exact.example.com.", "second.rpz.", "exact.example.com.second.rpz.", ActionLocalData},
+		{"EXACT.Example.COM.", "second.rpz.", "exact.example.com.second.rpz.", ActionLocalData},
+		{"www.example.com.", "second.rpz.", "*.example.com.second.rpz.", ActionNXDomain},
+		{"a.b.example.com.", "second.rpz.", "*.example.com.second.rpz.", ActionNXDomain},
+		{"example.com.", "", "", 0}, // a wildcard does not cover its apex
+		{"example.org.", "", "", 0},
+	}
+	for _, tt := range tests {
+		p := r.QName(dnsmessage.MustNewName(tt.name))
+		if tt.zone == "" {
+			if p != nil {
+				t.Errorf("%s: expected no policy, got %s", tt.name, p)
+			}
+			continue
+		}
+		if p == nil || p.Zone != tt.zone || p.Trigger != tt.trigger || p.Action != tt.action {
+			t.Errorf("%s: expected %s in %s (action %d), got %+v", tt.name, tt.trigger, tt.zone, tt.action, p)
+		}
+	}
+}
+
+func Test_PolicyExplain(t *testing.T) {
+	r := loadZones(t, first, second)
+
+	tests := map[string]string{
+		"ok.example.com.":     `passed through without the lists by trigger "ok.example.com" of rpz first.rpz.`,
+		"exact.example.com.":  `answered with local data by trigger "exact.example.com" of rpz second.rpz.`,
+		"www.example.com.":    `answered NXDOMAIN by trigger "*.example.com" of rpz second.rpz.`,
+		"search.example.com.": `answered with local data by trigger "search.example.com" of rpz second.rpz.`,
+	}
+	for name, want := range tests {
+		if got := r.QName(dnsmessage.MustNewName(name)).Explain(); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func Test_Response(t *testing.T) {
+	r := loadZones(t, first, second)
+	inFirst := r.QName(dnsmessage.MustNewName("ok.example.com."))
+	inSecond := r.QName(dnsmessage.MustNewName("www.example.com."))
+
+	// Only the first zone has response triggers before the second
+	if !r.NeedsResponse(nil) || !r.NeedsResponse(inSecond) || r.NeedsResponse(inFirst) {
+		t.Error("Expected only zones before the second to need the response")
+	}
+
+	nsEvil := record(t, "evil.net.", dnsmessage.TypeNS, "ns.evil.net.")
+	nsOther := record(t, "other.net.", dnsmessage.TypeNS, "ns.other.net.")
+	nsAddr := record(t, "ns.other.net.", dnsmessage.TypeA, "198.51.100.7")
+
+	tests := []struct {
+		name        string
+		answers     []entities.Record
+		nameservers []entities.Record
+		before      *Policy
+		trigger     string // "" when nothing matches
+	}{
+		{
+			name:    "answer address",
+			answers: []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "192.0.2.1")},
+			trigger: "32.1.2.0.192.rpz-ip.first.rpz.",
+		},
+		{
+			name:    "answer address in a later zone",
+			answers: []entities.Record{record(t, "x.example.net.", dnsmessage.TypeAAAA, "2001:db8::1")},
+			trigger: "48.zz.db8.2001.rpz-ip.second.rpz.",
+		},
+		{
+			name:    "zones from the question name trigger on are not checked",
+			answers: []entities.Record{record(t, "x.example.net.", dnsmessage.TypeAAAA, "2001:db8::1")},
+			before:  inSecond,
+		},
+		{
+			name:    "nor for a trigger in the first zone",
+			answers: []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "192.0.2.1")},
+			before:  inFirst,
+		},
+		{
+			name:        "nameserver name",
+			answers:     []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "203.0.113.1")},
+			nameservers: []entities.Record{nsOther, nsEvil},
+			trigger:     "ns.evil.net.rpz-nsdname.first.rpz.",
+		},
+		{
+			name:        "nameserver address",
+			answers:     []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "203.0.113.1")},
+			nameservers: []entities.Record{nsOther, nsAddr},
+			trigger:     "24.0.100.51.198.rpz-nsip.first.rpz.",
+		},
+		{
+			name:        "no answer, nameservers still count",
+			nameservers: []entities.Record{nsEvil},
+			trigger:     "ns.evil.net.rpz-nsdname.first.rpz.",
+		},
+		{
+			name:        "nothing matches",
+			answers:     []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "203.0.113.1")},
+			nameservers: []entities.Record{nsOther},
+		},
+	}
+	for _, tt := range tests {
+		lookups := 0
+		nameservers := func(dnsmessage.Name) []entities.Record {
+			lookups++
+			return tt.nameservers
+		}
+		result := entities.Result{RCode: dnsmessage.RCodeSuccess, Answers: tt.answers}
+		p := r.Response(dnsmessage.MustNewName("x.example.net."), result, nameservers, tt.before)
+		switch {
+		case tt.trigger == "" && p != nil:
+			t.Errorf("%s: expected no policy, got %s", tt.name, p)
+		case tt.trigger != "" && (p == nil || p.Trigger != tt.trigger):
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.trigger, p)
+		}
+		if lookups > 1 {
+			t.Errorf("%s: expected the nameservers to be looked up once, got %d", tt.name, lookups)
+		}
+	}
+}
+
+func Test_ResponseNameserverLookups(t *testing.T) {
+	var looked []string
+	nameservers := func(name dnsmessage.Name) []entities.Record {
+		looked = append(looked, name.String())
+		return nil
+	}
+	result := entities.Result{RCode: dnsmessage.RCodeSuccess, Answers: []entities.Record{
+		record(t, "www.example.net.", dnsmessage.TypeCNAME, "cdn.example.org."),
+		record(t, "cdn.example.org.", dnsmessage.TypeA, "203.0.113.1"),
+	}}
+
+	// Without nameserver triggers nothing is looked up
+	loadZones(t, second).Response(dnsmessage.MustNewName("www.example.net."), result, nameservers, nil)
+	if len(looked) != 0 {
+		t.Errorf("Expected no nameserver lookups, got %v", looked)
+	}
+
+	// The question and every CNAME target in the answer
+	loadZones(t, first).Response(dnsmessage.MustNewName("www.example.net."), result, nameservers, nil)
+	if len(looked) != 2 || looked[0] != "www.example.net." || looked[1] != "cdn.example.org." {
+		t.Errorf("Expected lookups for www.example.net. and cdn.example.org., got %v", looked)
+	}
+}
+
+func Test_Answer(t *testing.T) {
+	r := loadZones(t, first, second)
+	a := dnsmessage.TypeA
+
+	tests := []struct {
+		name   string
+		rtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+		answer string // first answer, "" for none
+	}{
+		{name: "www.example.com.", rtype: a, rcode: dnsmessage.RCodeNameError},
+		{name: "exact.example.com.", rtype: a, rcode: dnsmessage.RCodeSuccess, answer: "exact.example.com. A 192.0.2.9"},
+		{name: "exact.example.com.", rtype: dnsmessage.TypeAAAA, rcode: dnsmessage.RCodeSuccess},
+		{name: "search.example.com.", rtype: a, rcode: dnsmessage.RCodeSuccess, answer: "search.example.com. CNAME search.example.com.safe.example."},
+	}
+	for _, tt := range tests {
+		name := dnsmessage.MustNewName(tt.name)
+		result, err := r.QName(name).Answer(name, tt.rtype)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if result.RCode != tt.rcode {
+			t.Errorf("%s %s: expected %s, got %s", tt.name, tt.rtype, tt.rcode, result.RCode)
+		}
+		got := ""
+		if len(result.Answers) > 0 {
+			got = describe(result.Answers[0])
+		}
+		if got != tt.answer {
+			t.Errorf("%s %s: expected %q, got %q", tt.name, tt.rtype, tt.answer, got)
+		}
+		// Negative answers carry the zone's SOA
+		if got == "" && (len(result.Authority) != 1 || result.Authority[0].Name.String() != "second.rpz.") {
+			t.Errorf("%s %s: expected the SOA of second.rpz., got %v", tt.name, tt.rtype, result.Authority)
+		}
+	}
+
+	// Actions without a question name trigger, through the first zone's response triggers
+	answers := []entities.Record{record(t, "x.example.net.", dnsmessage.TypeA, "203.0.113.1")}
+	for _, tt := range []struct {
+		nameserver entities.Record
+		err        error
+		rcode      dnsmessage.RCode
+	}{
+		{nameserver: record(t, "evil.net.", dnsmessage.TypeNS, "ns.evil.net."), err: ErrDrop},
+		{nameserver: record(t, "ns.other.net.", dnsmessage.TypeA, "198.51.100.7"), rcode: dnsmessage.RCodeSuccess},
+	} {
+		nameservers := func(dnsmessage.Name) []entities.Record { return []entities.Record{tt.nameserver} }
+		name := dnsmessage.MustNewName("x.example.net.")
+		p := r.Response(name, entities.Result{Answers: answers}, nameservers, nil)
+		result, err := p.Answer(name, a)
+		if !errors.Is(err, tt.err) || (err == nil && (result.RCode != tt.rcode || len(result.Answers) != 0)) {
+			t.Errorf("%s: expected %v / %s without answers, got %v / %+v", p, tt.err, tt.rcode, err, result)
+		}
+	}
+}
+
+func describe(r entities.Record) string {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return r.Name.String() + " A " + r.IP().String()
+	case *dnsmessage.CNAMEResource:
+		return r.Name.String() + " CNAME " + body.CNAME.String()
+	}
+	return r.Name.String() + " " + r.RType.String()
+}
+
+func Test_LoadErrors(t *testing.T) {
+	for _, content := range []string{
+		"www.example.com. CNAME .\n",                 // outside the zone
+		"www CNAME .\nwww A 192.0.2.1\n",             // action and local data
+		"www A 192.0.2.1\nwww CNAME rpz-passthru.\n", // local data and action
+		"www CNAME rpz-tcp-only.\n",                  // not supported
+		"33.1.2.0.192.rpz-ip CNAME .\n",              // prefix too long
+		"www A not-an-address\n",                     // bad local data
+	} {
+		if _, err := Load([]Zone{{Name: "first.rpz", Path: writeZone(t, content)}}); err == nil {
+			t.Errorf("Expected %q to fail", content)
+		}
+	}
+
+	// Client IP triggers are skipped, not an error
+	r := loadZones(t, "32.1.2.0.192.rpz-client-ip CNAME .\n")
+	if r.NeedsResponse(nil) || r.QName(dnsmessage.MustNewName("32.1.2.0.192.rpz-client-ip.")) != nil {
+		t.Error("Expected the client IP trigger to be ignored")
+	}
+}
@@ -0,0 +1,191 @@
+package rpz
+
+import (
+	"bufio"
+	"dnsthingymagik/server/resolver/entities"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultTTL = 300 // until a $TTL or SOA says otherwise
+
+// rr is one record of a zone file, the owner fully qualified and lower case.
+type rr struct {
+	owner string
+	ttl   uint32
+	rtype string
+	rdata string
+	line  int
+}
+
+// Read a master file (RFC 1035 section 5): $ORIGIN and $TTL, relative names, @, owners
+// carried over from the previous line, parentheses spanning lines and ; comments.
+func parseZoneFile(path, origin string) ([]rr, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []rr
+	origin = entities.FQDN(strings.ToLower(origin))
+	ttl := uint32(defaultTTL)
+	ttlSet := false
+	owner := origin
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	var pending string // a record continued inside parentheses
+	pendingLine := 0
+	for scanner.Scan() {
+		lineNo++
+		line := stripComment(scanner.Text())
+
+		if pending != "" {
+			pending += " " + line
+			if strings.Count(pending, "(") > strings.Count(pending, ")") {
+				continue
+			}
+			line, pending = pending, ""
+		} else if strings.Count(line, "(") > strings.Count(line, ")") {
+			pending, pendingLine = line, lineNo
+			continue
+		} else {
+			pendingLine = lineNo
+		}
+		line = strings.NewReplacer("(", " ", ")", " ").Replace(line)
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		errorf := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, pendingLine, fmt.Sprintf(format, args...))
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return nil, errorf("$ORIGIN needs a name")
+			}
+			origin = absolute(strings.ToLower(fields[1]), origin)
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, errorf("$TTL needs a value")
+			}
+			ttl, err = parseTTL(fields[1])
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			ttlSet = true
+			continue
+		case "$INCLUDE":
+			return nil, errorf("$INCLUDE is not supported")
+		}
+
+		// A line starting with blank space belongs to the previous owner
+		if line[0] != ' ' && line[0] != '\t' {
+			owner = absolute(strings.ToLower(fields[0]), origin)
+			fields = fields[1:]
+		}
+
+		record := rr{owner: owner, ttl: ttl, line: pendingLine}
+		for len(fields) > 0 {
+			if t, err := parseTTL(fields[0]); err == nil {
+				record.ttl = t
+			} else if !isClass(fields[0]) {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, errorf("record without a type")
+		}
+		record.rtype = strings.ToUpper(fields[0])
+		record.rdata = strings.Join(fields[1:], " ")
+
+		// Without $TTL the SOA minimum is the default (RFC 2308 section 4)
+		if record.rtype == "SOA" && !ttlSet && len(fields) == 8 {
+			if minimum, err := parseTTL(fields[7]); err == nil {
+				ttl = minimum
+			}
+		}
+		records = append(records, record)
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("%s:%d: unbalanced parentheses", path, pendingLine)
+	}
+
+	return records, scanner.Err()
+}
+
+// Drop a ; comment, unless the ; is inside a quoted string.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// Seconds, or BIND style units like 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + uint64(c-'0')
+			digits = true
+		case units[c|0x20] != 0 && digits:
+			total += n * units[c|0x20]
+			n, digits = 0, false
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+	}
+	if digits || total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// Make a name from the zone file absolute, @ is the origin itself.
+func absolute(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	case origin == ".":
+		return name + "."
+	default:
+		return name + "." + origin
+	}
+}
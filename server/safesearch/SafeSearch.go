@@ -0,0 +1,160 @@
+package safesearch
+
+import (
+	"bufio"
+	"context"
+	"dnsthingymagik/server/filewatch"
+	"dnsthingymagik/server/resolver/entities"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TTL          = 300             // of the synthesized CNAME records
+	pollInterval = 5 * time.Second // how often the mapping file is checked for changes
+)
+
+// Country sites of Google search, each www.google.<tld> gets the safe endpoint
+var googleDomains = []string{
+	"com", "ad", "ae", "at", "be", "bg", "ca", "ch", "cl", "co.id", "co.il", "co.in", "co.jp",
+	"co.kr", "co.nz", "co.uk", "co.za", "com.ar", "com.au", "com.br", "com.hk", "com.mx",
+	"com.tr", "com.tw", "com.ua", "cz", "de", "dk", "ee", "es", "fi", "fr", "gr", "hr", "hu",
+	"ie", "it", "lt", "lv", "nl", "no", "pl", "pt", "ro", "rs", "ru", "se", "si", "sk",
+}
+
+// Built-in mapping, the file adds to it and overrides it
+func defaults() map[string]string {
+	m := map[string]string{
+		"www.bing.com":             "strict.bing.com",
+		"duckduckgo.com":           "safe.duckduckgo.com",
+		"www.duckduckgo.com":       "safe.duckduckgo.com",
+		"start.duckduckgo.com":     "safe.duckduckgo.com",
+		"www.youtube.com":          "restrict.youtube.com",
+		"m.youtube.com":            "restrict.youtube.com",
+		"youtubei.googleapis.com":  "restrict.youtube.com",
+		"youtube.googleapis.com":   "restrict.youtube.com",
+		"www.youtube-nocookie.com": "restrict.youtube.com",
+		"yandex.ru":                "familysearch.yandex.ru",
+		"yandex.com":               "familysearch.yandex.ru",
+		"www.yandex.ru":            "familysearch.yandex.ru",
+		"www.yandex.com":           "familysearch.yandex.ru",
+		"pixabay.com":              "safesearch.pixabay.com",
+		"search.brave.com":         "safesearch.brave.com",
+	}
+	for _, tld := range googleDomains {
+		m["www.google."+tld] = "forcesafesearch.google.com"
+	}
+
+	mapping := make(map[string]string)
+	for domain, target := range m {
+		mapping[domain+"."] = target + "."
+	}
+	return mapping
+}
+
+// Mapping rewrites search engine and video site names to their safe search endpoints.
+type Mapping struct {
+	path    string // "" when only the defaults are used
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	targets map[string]dnsmessage.Name
+}
+
+// Load reads the mapping file on top of the built-in defaults, path may be empty.
+func Load(path string) (*Mapping, error) {
+	m := &Mapping{path: path}
+	if path != "" {
+		m.watcher = filewatch.New(path)
+	}
+	err := m.reload()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mapping) reload() error {
+	mapping := defaults()
+	if m.path != "" {
+		err := parse(m.path, mapping)
+		if err != nil {
+			return err
+		}
+	}
+
+	targets := make(map[string]dnsmessage.Name, len(mapping))
+	for domain, target := range mapping {
+		name, err := dnsmessage.NewName(target)
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.path, err)
+		}
+		targets[domain] = name
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = targets
+	return nil
+}
+
+// Lines of the form: domain target [# comment]
+func parse(path string, mapping map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a domain and its safe search target", path, lineNo)
+		}
+		mapping[strings.ToLower(entities.FQDN(fields[0]))] = entities.FQDN(fields[1])
+	}
+	return scanner.Err()
+}
+
+// Target returns the safe search endpoint for name, if it has one.
+func (m *Mapping) Target(name dnsmessage.Name) (dnsmessage.Name, bool) {
+	if m == nil {
+		return dnsmessage.Name{}, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	target, ok := m.targets[strings.ToLower(name.String())]
+	return target, ok
+}
+
+// Watch rereads the mapping file whenever it changes, until ctx is done.
+func (m *Mapping) Watch(ctx context.Context) {
+	if m == nil || m.path == "" {
+		return
+	}
+
+	m.watcher.Run(ctx, pollInterval, func() {
+		err := m.reload()
+		if err != nil {
+			log.Printf("Safe search mapping reload error, keeping the old mapping: %v", err)
+			return
+		}
+		log.Printf("Reloaded safe search mapping %s", m.path)
+	})
+}
@@ -0,0 +1,113 @@
+package safesearch
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeMapping(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "safesearch.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func target(m *Mapping, name string) string {
+	target, ok := m.Target(dnsmessage.MustNewName(name))
+	if !ok {
+		return ""
+	}
+	return target.String()
+}
+
+func Test_Defaults(t *testing.T) {
+	m, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"www.google.com.":     "forcesafesearch.google.com.",
+		"WWW.Google.CO.UK.":   "forcesafesearch.google.com.",
+		"www.youtube.com.":    "restrict.youtube.com.",
+		"duckduckgo.com.":     "safe.duckduckgo.com.",
+		"www.bing.com.":       "strict.bing.com.",
+		"google.com.":         "", // only the search sites, not the whole domain
+		"mail.google.com.":    "",
+		"www.google.nowhere.": "",
+	}
+	for name, want := range tests {
+		if got := target(m, name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func Test_FileOverrides(t *testing.T) {
+	path := writeMapping(t, `# moderate instead of strict for YouTube
+www.youtube.com    restrictmoderate.youtube.com
+search.example.    safe.example.com.   # trailing comment
+
+Www.Bing.Com       strict.bing.com
+`)
+	m, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"www.youtube.com.": "restrictmoderate.youtube.com.", // the file wins over the defaults
+		"m.youtube.com.":   "restrict.youtube.com.",         // other defaults stay
+		"search.example.":  "safe.example.com.",
+		"www.bing.com.":    "strict.bing.com.",
+		"www.google.com.":  "forcesafesearch.google.com.",
+	}
+	for name, want := range tests {
+		if got := target(m, name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	for _, content := range []string{
+		"www.youtube.com\n",
+		"www.youtube.com a.example b.example\n",
+	} {
+		if _, err := Load(writeMapping(t, content)); err == nil {
+			t.Errorf("Expected %q to fail", content)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected a missing file to fail")
+	}
+}
+
+func Test_ReloadKeepsOldMapping(t *testing.T) {
+	path := writeMapping(t, "search.example safe.example\n")
+	m, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("broken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.reload(); err == nil {
+		t.Fatal("Expected the broken file to fail")
+	}
+	if got := target(m, "search.example."); got != "safe.example." {
+		t.Errorf("Expected the old mapping to stay, got %q", got)
+	}
+}
+
+func Test_NilMapping(t *testing.T) {
+	var m *Mapping
+	if _, ok := m.Target(dnsmessage.MustNewName("www.google.com.")); ok {
+		t.Error("Expected no target without a mapping")
+	}
+}
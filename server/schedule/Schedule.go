@@ -0,0 +1,156 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones work on hosts without a zoneinfo database
+)
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+}
+
+// Period is a daily time window on some days of the week, as written in the config.
+type Period struct {
+	Days []string // mon..sun, weekdays or weekend; every day when empty
+	From string   // HH:MM
+	To   string   // HH:MM, 24:00 for midnight; before From means the window ends the next day
+}
+
+// Schedule is a weekly set of time windows in one timezone.
+type Schedule struct {
+	Name    string
+	loc     *time.Location
+	windows []window
+}
+
+type window struct {
+	days     [7]bool
+	from, to int // minutes since midnight
+}
+
+// New parses a schedule, timezone is an IANA name like "Europe/Ljubljana", local time when empty.
+func New(name, timezone string, periods []Period) (*Schedule, error) {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", name, err)
+		}
+	}
+
+	s := &Schedule{Name: name, loc: loc}
+	for _, period := range periods {
+		w, err := parsePeriod(period)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", name, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parsePeriod(p Period) (window, error) {
+	var w window
+	if len(p.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range p.Days {
+		key := strings.ToLower(day)
+		days, ok := dayNames[key]
+		if !ok && len(key) > 3 {
+			// Full names, "monday"
+			days, ok = dayNames[key[:3]]
+		}
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", day)
+		}
+		for _, d := range days {
+			w.days[d] = true
+		}
+	}
+
+	var err error
+	w.from, err = parseClock(p.From)
+	if err != nil {
+		return w, err
+	}
+	w.to, err = parseClock(p.To)
+	if err != nil {
+		return w, err
+	}
+	if w.from == w.to {
+		return w, fmt.Errorf("period %s-%s is empty, use 00:00-24:00 for a whole day", p.From, p.To)
+	}
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	_, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// Active reports whether t falls in one of the windows.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		if w.from < w.to {
+			if w.days[today] && minute >= w.from && minute < w.to {
+				return true
+			}
+			continue
+		}
+		// Overnight window, started today or still running from yesterday
+		if (w.days[today] && minute >= w.from) || (w.days[yesterday] && minute < w.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns when Active next flips after t, zero if it never does.
+func (s *Schedule) NextChange(t time.Time) time.Time {
+	now := s.Active(t)
+	local := t.In(s.loc)
+
+	// Every window edge in the coming week, in order
+	var edges []time.Time
+	for day := 0; day <= 8; day++ {
+		date := local.AddDate(0, 0, day)
+		for _, w := range s.windows {
+			for _, minute := range []int{w.from, w.to} {
+				edge := time.Date(date.Year(), date.Month(), date.Day(), minute/60, minute%60, 0, 0, s.loc)
+				if edge.After(t) {
+					edges = append(edges, edge)
+				}
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Before(edges[j]) })
+
+	for _, edge := range edges {
+		if s.Active(edge) != now {
+			return edge
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,153 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+var ljubljana, _ = time.LoadLocation("Europe/Ljubljana")
+
+func at(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, ljubljana)
+}
+
+func mustNew(t *testing.T, periods ...Period) *Schedule {
+	t.Helper()
+	s, err := New("test", "Europe/Ljubljana", periods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_Active(t *testing.T) {
+	// 2026-03-02 is a Monday
+	s := mustNew(t,
+		Period{Days: []string{"weekdays"}, From: "09:00", To: "17:00"},
+		Period{Days: []string{"Friday"}, From: "22:00", To: "02:00"},
+	)
+
+	tests := []struct {
+		at     time.Time
+		active bool
+	}{
+		{at(2026, 3, 2, 8, 59), false},
+		{at(2026, 3, 2, 9, 0), true},
+		{at(2026, 3, 2, 16, 59), true},
+		{at(2026, 3, 2, 17, 0), false},
+		{at(2026, 3, 7, 12, 0), false}, // Saturday
+		{at(2026, 3, 6, 22, 0), true},  // Friday night
+		{at(2026, 3, 7, 1, 59), true},  // still Friday's window
+		{at(2026, 3, 7, 2, 0), false},
+		{at(2026, 3, 8, 1, 0), false}, // Saturday has no overnight window
+		// The same instant seen from UTC, 08:30 UTC is 09:30 in Ljubljana
+		{time.Date(2026, 3, 2, 8, 30, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		if got := s.Active(tt.at); got != tt.active {
+			t.Errorf("%s: expected active=%v, got %v", tt.at, tt.active, got)
+		}
+	}
+}
+
+func Test_NextChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		periods []Period
+		from    time.Time
+		want    time.Time // zero when it never flips
+	}{
+		{
+			name:    "to the window start",
+			periods: []Period{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}},
+			from:    at(2026, 3, 2, 8, 0),
+			want:    at(2026, 3, 2, 9, 0),
+		},
+		{
+			name:    "over the weekend",
+			periods: []Period{{Days: []string{"weekdays"}, From: "09:00", To: "17:00"}},
+			from:    at(2026, 3, 6, 18, 0),
+			want:    at(2026, 3, 9, 9, 0),
+		},
+		{
+			name:    "adjacent windows do not flip between them",
+			periods: []Period{{From: "08:00", To: "12:00"}, {From: "12:00", To: "16:00"}},
+			from:    at(2026, 3, 2, 9, 0),
+			want:    at(2026, 3, 2, 16, 0),
+		},
+		{
+			name:    "whole day every day never flips",
+			periods: []Period{{From: "00:00", To: "24:00"}},
+			from:    at(2026, 3, 2, 23, 59),
+		},
+		{
+			name:    "whole days end at midnight",
+			periods: []Period{{Days: []string{"weekend"}, From: "00:00", To: "24:00"}},
+			from:    at(2026, 3, 8, 12, 0),
+			want:    at(2026, 3, 9, 0, 0),
+		},
+		{
+			// Clocks go from 02:00 to 03:00 on 2026-03-29, the night is an hour shorter
+			name:    "overnight across the spring DST change",
+			periods: []Period{{From: "22:00", To: "06:00"}},
+			from:    at(2026, 3, 28, 23, 0),
+			want:    at(2026, 3, 29, 6, 0),
+		},
+		{
+			// And back from 03:00 to 02:00 on 2026-10-25
+			name:    "overnight across the autumn DST change",
+			periods: []Period{{From: "22:00", To: "06:00"}},
+			from:    at(2026, 10, 24, 23, 0),
+			want:    at(2026, 10, 25, 6, 0),
+		},
+		{
+			name:    "a window in the skipped hour does not happen that day",
+			periods: []Period{{From: "02:15", To: "02:45"}},
+			from:    at(2026, 3, 29, 1, 0),
+			want:    at(2026, 3, 30, 2, 15),
+		},
+		{
+			name:    "start on the day after the spring DST change",
+			periods: []Period{{Days: []string{"mon"}, From: "07:00", To: "08:00"}},
+			from:    at(2026, 3, 28, 12, 0),
+			want:    at(2026, 3, 30, 7, 0),
+		},
+	}
+
+	for _, tt := range tests {
+		s := mustNew(t, tt.periods...)
+		got := s.NextChange(tt.from)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// Wall clock times, not durations: the spring night is 7 hours, the autumn one 9
+	s := mustNew(t, Period{From: "22:00", To: "06:00"})
+	for _, tt := range []struct {
+		start time.Time
+		hours float64
+	}{{at(2026, 3, 28, 22, 0), 7}, {at(2026, 10, 24, 22, 0), 9}} {
+		if got := s.NextChange(tt.start).Sub(tt.start).Hours(); got != tt.hours {
+			t.Errorf("From %s: expected the window to last %v hours, got %v", tt.start, tt.hours, got)
+		}
+	}
+}
+
+func Test_NewErrors(t *testing.T) {
+	tests := []Period{
+		{Days: []string{"funday"}, From: "09:00", To: "17:00"},
+		{From: "9", To: "17:00"},
+		{From: "09:00", To: "24:30"},
+		{From: "09:60", To: "17:00"},
+		{From: "09:00", To: "09:00"},
+	}
+	for _, period := range tests {
+		if _, err := New("bad", "", []Period{period}); err == nil {
+			t.Errorf("Expected %+v to be rejected", period)
+		}
+	}
+	if _, err := New("bad", "Mars/Olympus", nil); err == nil {
+		t.Error("Expected an unknown timezone to be rejected")
+	}
+}
@@ -439,9 +439,18 @@ func Test_MalformedQuery(t *testing.T) {
 	}
 }
 
-// Test Unknown Record Type Handling
+// Test Unknown Record Type Handling, unknown types are resolved opaquely (RFC 3597)
 func Test_UnknownRecordType(t *testing.T) {
-	response := sendDNSQuery(t, "127.0.0.1:53", "govekar.net.", dnsmessage.Type(99), true) // Unknown type
+	response := sendDNSQuery(t, "127.0.0.1:53", "govekar.net.", dnsmessage.Type(65280), true) // Private use type
+
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected RCODE 0 (NoError), got %d", response.Header.RCode)
+	}
+}
+
+// Test Meta Query Type Handling
+func Test_ZoneTransferNotImplemented(t *testing.T) {
+	response := sendDNSQuery(t, "127.0.0.1:53", "govekar.net.", dnsmessage.TypeAXFR, true)
 
 	if response.Header.RCode != dnsmessage.RCodeNotImplemented {
 		t.Errorf("Expected NOTIMPLEMENTED (RCODE 4), got %d", response.Header.RCode)